@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+const benchRecordVersion = 1
+
+// BenchRecord is a sealing benchmark run as saved by `ubi-bench sealing`.
+type BenchRecord struct {
+	Version     int
+	Created     time.Time
+	Hardware    Hardware
+	Concurrency ParCfg
+	BenchResults
+}
+
+// Hardware identifies the machine a benchmark ran on, runs are only comparable on equal
+// hardware and environment.
+type Hardware struct {
+	Hostname string
+	OS       string
+	Arch     string
+	CPUModel string
+	CPUCores int
+	MemTotal uint64   // bytes
+	GPUs     []string // models of the NVIDIA GPUs found
+}
+
+func collectHardware() Hardware {
+	hw := Hardware{
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		CPUCores: runtime.NumCPU(),
+	}
+	hw.Hostname, _ = os.Hostname()
+	hw.CPUModel = procField("/proc/cpuinfo", "model name")
+	hw.MemTotal = procKB("/proc/meminfo", "MemTotal")
+	infos, _ := filepath.Glob("/proc/driver/nvidia/gpus/*/information")
+	for _, info := range infos {
+		if model := procField(info, "Model"); model != "" {
+			hw.GPUs = append(hw.GPUs, model)
+		}
+	}
+	return hw
+}
+
+// procField returns the value of the first "key: value" line of key in a /proc style file.
+func procField(path, key string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(k) == key {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+func (hw Hardware) String() string {
+	gpu := "no gpu"
+	if len(hw.GPUs) > 0 {
+		gpu = strings.Join(hw.GPUs, ", ")
+	}
+	return fmt.Sprintf("%s, %d cores, %s RAM, %s", hw.CPUModel, hw.CPUCores, sizeStr(new(big.Int).SetUint64(hw.MemTotal)), gpu)
+}
+
+func sizeStr(b *big.Int) string {
+	return types.SizeStr(types.BigInt{Int: b})
+}
+
+func writeBenchRecord(path string, rec *BenchRecord) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func readBenchRecord(path string) (*BenchRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec BenchRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, xerrors.Errorf("parsing %s: %w", path, err)
+	}
+	if rec.Version != benchRecordVersion {
+		return nil, xerrors.Errorf("%s: unsupported bench record version %d", path, rec.Version)
+	}
+	if rec.SectorNumber <= 0 {
+		return nil, xerrors.Errorf("%s: no sealed sectors", path)
+	}
+	return &rec, nil
+}
+
+var benchCmd = &cli.Command{
+	Name:  "bench",
+	Usage: "Work with saved sealing benchmark results",
+	Subcommands: []*cli.Command{
+		benchCompareCmd,
+	},
+}
+
+var benchCompareCmd = &cli.Command{
+	Name:      "compare",
+	Usage:     "Compare sealing throughput of result files against the first one",
+	ArgsUsage: "<baseline.json> <result.json>...",
+	Flags: []cli.Flag{
+		&cli.Float64Flag{
+			Name:  "threshold",
+			Usage: "throughput drop in percent that counts as a regression",
+			Value: 5,
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() < 2 {
+			return xerrors.Errorf("Usage: ubi-bench bench compare <baseline.json> <result.json>...")
+		}
+		var recs []*BenchRecord
+		for _, path := range c.Args().Slice() {
+			rec, err := readBenchRecord(path)
+			if err != nil {
+				return err
+			}
+			if len(recs) > 0 && rec.SectorSize != recs[0].SectorSize {
+				return xerrors.Errorf("%s sealed %d byte sectors, the baseline %d byte sectors", path, rec.SectorSize, recs[0].SectorSize)
+			}
+			recs = append(recs, rec)
+		}
+
+		base := recs[0]
+		fmt.Printf("baseline: %s (%s)\n", c.Args().First(), base.Created.Format(time.RFC3339))
+		fmt.Printf("  %s\n", base.Hardware)
+		var regressions int
+		for i, rec := range recs {
+			if i > 0 {
+				fmt.Printf("%s (%s)\n", c.Args().Get(i), rec.Created.Format(time.RFC3339))
+				if rec.Hardware.String() != base.Hardware.String() {
+					fmt.Printf("  hardware differs: %s\n", rec.Hardware)
+				}
+				if diff := envDiff(base.EnvVar, rec.EnvVar); diff != "" {
+					fmt.Printf("  environment differs: %s\n", diff)
+				}
+			}
+			for _, phase := range []struct {
+				name       string
+				base, curr time.Duration
+			}{
+				{"addPiece", base.SealingSum.AddPiece, rec.SealingSum.AddPiece},
+				{"preCommit phase 1", base.SealingSum.PreCommit1, rec.SealingSum.PreCommit1},
+				{"preCommit phase 2", base.SealingSum.PreCommit2, rec.SealingSum.PreCommit2},
+				{"commit phase 1", base.SealingSum.Commit1, rec.SealingSum.Commit1},
+				{"commit phase 2", base.SealingSum.Commit2, rec.SealingSum.Commit2},
+				{"verify", base.SealingSum.Verify, rec.SealingSum.Verify},
+				{"wall time", base.WallTime, rec.WallTime},
+			} {
+				if phase.curr == 0 || (i > 0 && phase.base == 0) {
+					continue // not measured by one of the runs
+				}
+				curr := throughput(rec.SectorSize, rec.SectorNumber, phase.curr)
+				if i == 0 {
+					fmt.Printf("  %-18s %s\n", phase.name, sizeStr(curr)+"/s")
+					continue
+				}
+				change := relativeChange(throughput(base.SectorSize, base.SectorNumber, phase.base), curr)
+				mark := ""
+				if change < -c.Float64("threshold") {
+					mark = "  REGRESSION"
+					regressions++
+				}
+				fmt.Printf("  %-18s %s (%+.1f%%)%s\n", phase.name, sizeStr(curr)+"/s", change, mark)
+			}
+		}
+		if regressions > 0 {
+			return xerrors.Errorf("found %d throughput regressions of more than %.1f%%", regressions, c.Float64("threshold"))
+		}
+		return nil
+	},
+}
+
+// throughput returns the bytes per second bps prints.
+func throughput(sectorSize abi.SectorSize, sectorNum int, d time.Duration) *big.Int {
+	if d <= 0 {
+		return new(big.Int)
+	}
+	bdata := new(big.Int).SetUint64(uint64(sectorSize))
+	bdata = bdata.Mul(bdata, big.NewInt(int64(sectorNum)))
+	bdata = bdata.Mul(bdata, big.NewInt(time.Second.Nanoseconds()))
+	return bdata.Div(bdata, big.NewInt(d.Nanoseconds()))
+}
+
+// relativeChange returns the change from base to curr in percent.
+func relativeChange(base, curr *big.Int) float64 {
+	if base.Sign() == 0 {
+		return 0
+	}
+	b, _ := new(big.Float).SetInt(base).Float64()
+	c, _ := new(big.Float).SetInt(curr).Float64()
+	return (c - b) / b * 100
+}
+
+func envDiff(base, curr map[string]string) string {
+	var diffs []string
+	for k, v := range curr {
+		if bv, ok := base[k]; !ok || bv != v {
+			diffs = append(diffs, k+"="+v)
+		}
+	}
+	for k := range base {
+		if _, ok := curr[k]; !ok {
+			diffs = append(diffs, "-"+k)
+		}
+	}
+	sort.Strings(diffs)
+	return strings.Join(diffs, " ")
+}
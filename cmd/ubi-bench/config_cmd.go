@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	ubibenchmark "github.com/swanchain/ubi-benchmark"
+	"github.com/swanchain/ubi-benchmark/utils"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+	"golang.org/x/xerrors"
+)
+
+var configCmd = &cli.Command{
+	Name:  "config",
+	Usage: "Create, check and print the config file given by --config",
+	Subcommands: []*cli.Command{
+		configInitCmd,
+		configValidateCmd,
+		configShowCmd,
+		configKeystoreCmd,
+	},
+}
+
+var configInitCmd = &cli.Command{
+	Name:  "init",
+	Usage: "Write a commented config template",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "overwrite an existing file",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		path, err := utils.ConfigPath()
+		if err != nil {
+			return err
+		}
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if !c.Bool("force") {
+			flags |= os.O_EXCL
+		}
+		f, err := os.OpenFile(path, flags, 0600)
+		if os.IsExist(err) {
+			return xerrors.Errorf("%s already exists, use --force to overwrite it", path)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteString(ubibenchmark.ConfigTemplate); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("wrote %s, fill in the [MCS] and [HUB] sections before starting the daemon\n", path)
+		return nil
+	},
+}
+
+var configValidateCmd = &cli.Command{
+	Name:  "validate",
+	Usage: "Check the config file and the UBI_* environment overrides",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "probe",
+			Usage: "also check that the hub and the storage backends are reachable with the configured credentials",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "timeout of every probe",
+			Value: 15 * time.Second,
+		},
+	},
+	Action: func(c *cli.Context) error {
+		utils.RequireHub()
+		cfg, err := utils.ReloadConfig()
+		if err != nil {
+			return err
+		}
+		path, _ := utils.ConfigPath()
+		fmt.Printf("%s is valid\n", path)
+		if !c.Bool("probe") {
+			return nil
+		}
+
+		type probe struct {
+			name string
+			run  func(ctx context.Context) error
+		}
+		hub := NewHubClient(cfg.HUB)
+		hub.maxRetries = 0
+		probes := []probe{
+			{"hub HUB_URL", func(ctx context.Context) error { return probeUrl(ctx, hub, cfg.HUB.HubUrl) }},
+			{"hub TASK_URL", func(ctx context.Context) error {
+				_, err := hub.TaskStats(ctx, 0)
+				return err
+			}},
+		}
+		for _, backend := range cfg.StorageBackends() {
+			backend := backend
+			probes = append(probes, probe{"storage " + backend, func(ctx context.Context) error {
+				return probeBackend(ctx, backend)
+			}})
+		}
+
+		var failed int
+		for _, p := range probes {
+			ctx, cancel := context.WithTimeout(c.Context, c.Duration("timeout"))
+			err := p.run(ctx)
+			cancel()
+			if err != nil {
+				failed++
+				fmt.Printf("%-16s FAILED: %v\n", p.name, err)
+				continue
+			}
+			fmt.Printf("%-16s ok\n", p.name)
+		}
+		if failed > 0 {
+			return xerrors.Errorf("%d of %d probes failed", failed, len(probes))
+		}
+		return nil
+	},
+}
+
+var configShowCmd = &cli.Command{
+	Name:  "show",
+	Usage: "Print the effective config, including UBI_* environment overrides, with secrets redacted",
+	Action: func(c *cli.Context) error {
+		cfg, err := utils.ReloadConfig()
+		if err != nil {
+			return err
+		}
+		path, _ := utils.ConfigPath()
+		fmt.Printf("# effective config of %s\n", path)
+		return toml.NewEncoder(os.Stdout).Encode(cfg.Redacted())
+	},
+}
+
+var keystoreFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:     "keystore",
+		Usage:    "path to the keystore file",
+		EnvVars:  []string{"UBI_SECRETS_KEYSTORE"},
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:    "passphrase-file",
+		Usage:   "file holding the keystore passphrase, " + utils.KeystorePassphraseEnv + " or a prompt is used when unset",
+		EnvVars: []string{"UBI_SECRETS_PASSPHRASE_FILE"},
+	},
+}
+
+var configKeystoreCmd = &cli.Command{
+	Name:  "keystore",
+	Usage: "Manage the encrypted keystore referenced as keystore:NAME in the config",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "set",
+			Usage:     "Add or replace an entry, the secret is read from stdin",
+			ArgsUsage: "<name>",
+			Flags:     keystoreFlags,
+			Action: func(c *cli.Context) error {
+				name := c.Args().First()
+				if name == "" {
+					return xerrors.Errorf("Usage: ubi-bench config keystore set <name>")
+				}
+				passphrase, err := keystorePassphrase(c)
+				if err != nil {
+					return err
+				}
+				entries, err := utils.OpenKeystore(c.String("keystore"), passphrase)
+				if err != nil {
+					return err
+				}
+				secret, err := readSecret("secret for " + name)
+				if err != nil {
+					return err
+				}
+				if secret == "" {
+					return xerrors.Errorf("empty secret")
+				}
+				entries[name] = secret
+				if err := utils.SaveKeystore(c.String("keystore"), passphrase, entries); err != nil {
+					return err
+				}
+				fmt.Printf("stored %s, reference it as \"keystore:%s\"\n", name, name)
+				return nil
+			},
+		},
+		{
+			Name:      "remove",
+			Usage:     "Remove an entry",
+			ArgsUsage: "<name>",
+			Flags:     keystoreFlags,
+			Action: func(c *cli.Context) error {
+				passphrase, err := keystorePassphrase(c)
+				if err != nil {
+					return err
+				}
+				entries, err := utils.OpenKeystore(c.String("keystore"), passphrase)
+				if err != nil {
+					return err
+				}
+				if _, ok := entries[c.Args().First()]; !ok {
+					return xerrors.Errorf("keystore has no entry %q", c.Args().First())
+				}
+				delete(entries, c.Args().First())
+				return utils.SaveKeystore(c.String("keystore"), passphrase, entries)
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "List the entry names",
+			Flags: keystoreFlags,
+			Action: func(c *cli.Context) error {
+				passphrase, err := keystorePassphrase(c)
+				if err != nil {
+					return err
+				}
+				entries, err := utils.OpenKeystore(c.String("keystore"), passphrase)
+				if err != nil {
+					return err
+				}
+				var names []string
+				for name := range entries {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					fmt.Println(name)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+func keystorePassphrase(c *cli.Context) (string, error) {
+	passphrase, err := utils.KeystorePassphrase(utils.SECRETS{PassphraseFile: c.String("passphrase-file")})
+	if err == nil {
+		return passphrase, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", err
+	}
+	return readSecret("keystore passphrase")
+}
+
+// readSecret prompts for a secret without echoing it, or reads the first line of stdin when it
+// is not a terminal.
+func readSecret(prompt string) (string, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintf(os.Stderr, "%s: ", prompt)
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// probeUrl checks that url answers at all. Any response below 500 counts, the submit endpoint
+// does not have to accept an empty request.
+func probeUrl(ctx context.Context, hub *HubClient, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	hub.authorize(req, nil, time.Now())
+	resp, err := hub.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return xerrors.Errorf("status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func probeBackend(ctx context.Context, backend string) error {
+	switch backend {
+	case utils.StoreMcs:
+		return utils.CheckMcsLogin()
+	case utils.StoreTitan:
+		_, err := utils.NewTiTanClient(utils.GetConfig().HUB.TITAN_KEY)
+		return err
+	}
+	store, err := utils.NewArtifactStore(backend)
+	if err != nil {
+		return err
+	}
+	_, err = store.List(ctx, "fil-c2/")
+	return err
+}
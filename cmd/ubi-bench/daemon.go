@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/storage/sealer/ffiwrapper"
+	"github.com/swanchain/ubi-benchmark/utils"
+	"golang.org/x/xerrors"
+)
+
+const taskCopies = 20
+
+// taskSupplier pairs an artifact store with the hub source its tasks are reported under.
+// threshold is the store's default low watermark, see replenishPolicy.
+type taskSupplier struct {
+	store     utils.ArtifactStore
+	source    int
+	threshold int
+}
+
+func newTaskSuppliers() ([]taskSupplier, error) {
+	stores, err := utils.NewArtifactStores()
+	if err != nil {
+		return nil, err
+	}
+
+	var suppliers []taskSupplier
+	for _, store := range stores {
+		supplier := taskSupplier{
+			store:     store,
+			source:    utils.GetConfig().StoreSource(store.Name()),
+			threshold: 40000,
+		}
+		if store.Name() == utils.StoreTitan {
+			supplier.threshold = 10000
+		}
+		suppliers = append(suppliers, supplier)
+	}
+	return suppliers, nil
+}
+
+// sectorTemplate is a sealed sector whose Commit1In the daemon recomputes at new heights. Each
+// template supplies the CPU and GPU resources of its sector type.
+type sectorTemplate struct {
+	maddr      address.Address
+	c1in       Commit1In
+	sectorType int64 // 512 or 32
+	taskType   int   // 1:Fil-C2-512M, 4:Fil-C2-32G
+	prefix     string
+}
+
+func loadSectorTemplate(path string) (*sectorTemplate, error) {
+	inb, err := os.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("reading input file: %w", err)
+	}
+	var c1in Commit1In
+	if err := json.Unmarshal(inb, &c1in); err != nil {
+		return nil, xerrors.Errorf("unmarshalling input file %s: %w", path, err)
+	}
+
+	maddr, err := address.NewFromString("t0" + c1in.Sid.ID.Miner.String())
+	if err != nil {
+		return nil, err
+	}
+
+	t := &sectorTemplate{
+		maddr: maddr,
+		c1in:  c1in,
+	}
+	switch c1in.SectorSize {
+	case 512 << 20:
+		t.sectorType = 512
+		t.taskType = 1
+		t.prefix = "fil-c2/512M"
+	case 32 << 30:
+		t.sectorType = 32
+		t.taskType = 4
+		t.prefix = "fil-c2/32G"
+	default:
+		return nil, xerrors.Errorf("input file %s: unsupported sector size %d", path, c1in.SectorSize)
+	}
+	return t, nil
+}
+
+// supplies reports whether tasks of resourceId are generated from the template.
+func (t *sectorTemplate) supplies(resourceId int) bool {
+	if t.sectorType == 512 {
+		return resourceId == CPU512 || resourceId == GPU512
+	}
+	return resourceId == CPU32G || resourceId == GPU32G
+}
+
+// daemon keeps the hub supplied with Commit1 outputs generated from one template per sector type.
+type daemon struct {
+	sealer     *ffiwrapper.Sealer
+	sdir       string
+	templates  []*sectorTemplate
+	suppliers  []taskSupplier
+	randomness utils.RandomnessSource
+	chain      utils.ChainHead // nil when heights are counted locally
+	ledger     *TaskLedger
+	pipeline   *pipeline
+	policy     *replenishPolicy
+	stat       *daemonStatus
+
+	lk  sync.Mutex
+	hub *HubClient // replaced on config reload
+}
+
+// tick queues new tasks for every store whose hub queue runs low. It never waits for the
+// pipeline, tasks that do not fit are picked up on a later tick.
+func (d *daemon) tick(ctx context.Context) {
+	d.resume()
+	budget, err := d.heightBudget(ctx)
+	if err != nil {
+		log.Errorf("Failed get chain head, not queueing new tasks: %v", err)
+		return
+	}
+	for _, supplier := range d.suppliers {
+		if ctx.Err() != nil {
+			return
+		}
+		d.checkTaskCount(ctx, supplier, budget)
+	}
+}
+
+// heightBudget returns how many heights every sector type may still take before it passes the
+// usable chain head, nil when the daemon does not follow a chain.
+func (d *daemon) heightBudget(ctx context.Context) (map[int64]int64, error) {
+	if d.chain == nil {
+		return nil, nil
+	}
+	head, err := d.chain.ChainHeight(ctx)
+	d.stat.chainResult(head, err)
+	if err != nil {
+		return nil, err
+	}
+	chainHead.Set(float64(head))
+
+	usable := head - utils.GetConfig().CHAIN.Confidence
+	budget := make(map[int64]int64)
+	for _, tmpl := range d.templates {
+		budget[tmpl.sectorType] = max(usable-d.ledger.NextHeight(tmpl.sectorType)+1, 0)
+	}
+	return budget, nil
+}
+
+func (d *daemon) hubClient() *HubClient {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.hub
+}
+
+// reload applies a changed config.toml: the hub client, the replenish policy, the check
+// interval and CHAIN.CONFIDENCE change live, the remaining sections only take effect after a
+// restart.
+func (d *daemon) reload(ticker *time.Ticker) {
+	old := utils.GetConfig()
+	cfg, err := utils.ReloadConfig()
+	if err != nil {
+		log.Errorf("Failed reload config, keeping the current one: %v", err)
+		return
+	}
+
+	d.lk.Lock()
+	d.hub = NewHubClient(cfg.HUB)
+	d.lk.Unlock()
+	d.policy.reload(cfg.POLICY)
+	if cfg.HUB.CheckInterval > 0 {
+		ticker.Reset(time.Duration(cfg.HUB.CheckInterval) * time.Minute)
+	}
+
+	for name, changed := range map[string]bool{
+		"MCS":        !reflect.DeepEqual(old.MCS, cfg.MCS),
+		"STORAGE":    !reflect.DeepEqual(old.STORAGE, cfg.STORAGE),
+		"LOCAL":      !reflect.DeepEqual(old.LOCAL, cfg.LOCAL),
+		"S3":         !reflect.DeepEqual(old.S3, cfg.S3),
+		"PIPELINE":   !reflect.DeepEqual(old.PIPELINE, cfg.PIPELINE),
+		"METRICS":    !reflect.DeepEqual(old.METRICS, cfg.METRICS),
+		"STATUS":     !reflect.DeepEqual(old.STATUS, cfg.STATUS),
+		"RANDOMNESS": !reflect.DeepEqual(old.RANDOMNESS, cfg.RANDOMNESS),
+		"CHAIN.FOLLOW": old.CHAIN.Follow != cfg.CHAIN.Follow || old.CHAIN.LotusApi != cfg.CHAIN.LotusApi ||
+			old.CHAIN.FakeStart != cfg.CHAIN.FakeStart || old.CHAIN.FakeBlockDelay != cfg.CHAIN.FakeBlockDelay,
+		"HUB.ENABLE_TITAN": old.HUB.ENABLE_TITAN != cfg.HUB.ENABLE_TITAN ||
+			old.HUB.TITAN_KEY != cfg.HUB.TITAN_KEY ||
+			old.HUB.TITAN_FOLDER_512 != cfg.HUB.TITAN_FOLDER_512 ||
+			old.HUB.TITAN_FOLDER_32 != cfg.HUB.TITAN_FOLDER_32,
+	} {
+		if changed {
+			log.Warnf("config: changes to %s take effect after a restart", name)
+		}
+	}
+	log.Infof("config reloaded")
+}
+
+// resume queues tasks left over by an earlier tick or a previous run of the daemon. Failed tasks
+// wait for their backoff to pass.
+func (d *daemon) resume() {
+	now := time.Now()
+	for _, rec := range d.ledger.Unfinished() {
+		if d.pipeline.inFlight(rec) || now.Before(rec.NextAttempt) {
+			continue
+		}
+		supplier, ok := d.supplier(rec.Store)
+		if !ok {
+			log.Warnf("store %s of task %s is not configured, skipping it", rec.Store, rec.Key())
+			continue
+		}
+		if d.template(rec.SectorType) == nil {
+			log.Warnf("no c1in template for sector type %d of task %s, skipping it", rec.SectorType, rec.Key())
+			continue
+		}
+		if !d.pipeline.enqueue(supplier, rec) {
+			return
+		}
+		log.Infof("resuming task %s, status: %s", rec.Key(), rec.Status)
+	}
+}
+
+func (d *daemon) template(sectorType int64) *sectorTemplate {
+	for _, t := range d.templates {
+		if t.sectorType == sectorType {
+			return t
+		}
+	}
+	return nil
+}
+
+func (d *daemon) supplier(store string) (taskSupplier, bool) {
+	for _, supplier := range d.suppliers {
+		if supplier.store.Name() == store {
+			return supplier, true
+		}
+	}
+	return taskSupplier{}, false
+}
+
+func (d *daemon) checkTaskCount(ctx context.Context, supplier taskSupplier, budget map[int64]int64) {
+	taskStats, err := d.hubClient().TaskStats(ctx, supplier.source)
+	d.stat.hubResult(supplier.source, taskStats, err)
+	if err != nil {
+		log.Errorf("Failed get task stats, store: %s, error: %v", supplier.store.Name(), err)
+		return
+	}
+
+	log.Infof("current task stats, store: %s, stats: %+v", supplier.store.Name(), taskStats.Data)
+	observeTaskStats(supplier.source, taskStats)
+	sort.Sort(taskStats.Data)
+
+	// resources of every sector type share the tick's budget and the room left in the pipeline
+	var plans []replenishPlan
+	var templates []*sectorTemplate
+	for _, t := range taskStats.Data {
+		for _, tmpl := range d.templates {
+			if !tmpl.supplies(t.ResourceId) {
+				continue
+			}
+			if plan := d.policy.plan(supplier.source, t, supplier.threshold); plan.Tasks > 0 {
+				plans = append(plans, plan)
+				templates = append(templates, tmpl)
+			}
+		}
+	}
+	if len(plans) == 0 {
+		return
+	}
+
+	plans = distributeTasks(plans, min(d.policy.tickBudget(), d.pipeline.room()))
+	for i, plan := range plans {
+		tmpl := templates[i]
+		var resourceType int // 0: cpu 1: gpu
+		if plan.ResourceId == GPU512 || plan.ResourceId == GPU32G {
+			resourceType = 1
+		}
+		var task = Task{
+			Type:         tmpl.taskType,
+			ResourceID:   plan.ResourceId,
+			ResourceType: resourceType,
+			Source:       supplier.source,
+		}
+
+		if budget != nil {
+			if left := budget[tmpl.sectorType]; int64(plan.Tasks) > left {
+				log.Infof("chain head leaves %d heights of sector type %d, queueing %d of %d tasks for resource %d", left, tmpl.sectorType, left, plan.Tasks, plan.ResourceId)
+				plan.Tasks = int(left)
+			}
+			if plan.Tasks == 0 {
+				continue
+			}
+		}
+
+		log.Infof("queueing %d tasks for resource %d, store: %s, shortfall: %d", plan.Tasks, plan.ResourceId, supplier.store.Name(), plan.Shortfall)
+		for i := 0; i < plan.Tasks; i++ {
+			// only reserve heights the pipeline can take now, the rest are asked for on a later tick
+			if d.pipeline.room() <= 0 {
+				log.Infof("pipeline is full, queued %d of %d tasks for resource %d", i, plan.Tasks, plan.ResourceId)
+				return
+			}
+			rec, err := d.ledger.Reserve(tmpl.sectorType, supplier.store.Name(), tmpl.prefix, task, plan.Copies)
+			if err != nil {
+				log.Errorf("Failed reserve task height, error: %v", err)
+				return
+			}
+			if budget != nil {
+				budget[tmpl.sectorType]--
+			}
+			nextHeight.WithLabelValues(strconv.FormatInt(tmpl.sectorType, 10)).Set(float64(rec.Height + 1))
+			if !d.pipeline.enqueue(supplier, rec) {
+				// draining, the task stays pending in the ledger and is resumed on the next run
+				return
+			}
+		}
+	}
+}
+
+// The pipeline stages below move a task through Commit1, compression, upload and hub
+// submission, recording every step in the ledger so that an interrupted task continues where
+// it stopped.
+
+func (d *daemon) commit1(ctx context.Context, job *pipelineJob) error {
+	tmpl := d.template(job.rec.SectorType)
+	if tmpl == nil {
+		return xerrors.Errorf("no c1in template for sector type %d", job.rec.SectorType)
+	}
+	start := time.Now()
+	sampler := startSampler("")
+	c2in, err := commitPhase1(ctx, d.randomness, tmpl.maddr, d.sealer, tmpl.c1in, job.rec.Height)
+	observeResources("commit1", tmpl.sectorType, sampler.Stop())
+	if err != nil {
+		return xerrors.Errorf("generating c1 out: %w", err)
+	}
+	commit1Duration.WithLabelValues(strconv.FormatInt(tmpl.sectorType, 10)).Observe(time.Since(start).Seconds())
+	job.c2in = c2in
+	return nil
+}
+
+func (d *daemon) compress(ctx context.Context, job *pipelineJob) error {
+	sampler := startSampler(c1OutDir(d.sdir, job.c2in))
+	out, err := writeC1Out(ctx, d.sdir, job.c2in)
+	observeResources("compress", job.rec.SectorType, sampler.Stop())
+	if err != nil {
+		return xerrors.Errorf("writing c1 out: %w", err)
+	}
+	job.c2in = nil
+	if out.CompressedSize > 0 {
+		compressionRatio.WithLabelValues(strconv.FormatInt(job.rec.SectorType, 10)).Observe(float64(out.RawSize) / float64(out.CompressedSize))
+	}
+	rootDir := out.RootDir
+
+	files, err := os.ReadDir(rootDir)
+	if err != nil {
+		return err
+	}
+
+	rec := &job.rec
+	rec.RootDir = rootDir
+	rec.TaskDir = out.TaskDir
+	rec.Artifacts = nil
+	for _, f := range files {
+		if !f.IsDir() {
+			rec.Artifacts = append(rec.Artifacts, filepath.Join(rootDir, f.Name()))
+		}
+	}
+	rec.Status = TaskGenerated
+	return d.ledger.Update(*rec)
+}
+
+func (d *daemon) upload(ctx context.Context, job *pipelineJob) error {
+	rec := &job.rec
+	store := job.supplier.store
+
+	var upload TaskUpload
+	for _, artifact := range rec.Artifacts {
+		name := filepath.Base(artifact)
+		fileUrl := d.uploadArtifact(ctx, store, rec.Prefix+"/"+rec.TaskDir+"/"+name, artifact)
+		if fileUrl == "" {
+			return xerrors.Errorf("upload %s to %s failed", name, store.Name())
+		}
+		log.Debugf("uploaded %s to %s", name, store.Name())
+		if strings.Contains(name, "verify") {
+			upload.VerifyParam = fileUrl
+		} else {
+			upload.InputParam = fileUrl
+		}
+	}
+	if upload.InputParam == "" || upload.VerifyParam == "" {
+		return xerrors.Errorf("task %s is missing artifacts", rec.TaskDir)
+	}
+
+	upload.UploadedAt = time.Now()
+	if rec.Uploads == nil {
+		rec.Uploads = make(map[string]TaskUpload)
+	}
+	rec.Uploads[store.Name()] = upload
+	rec.Status = TaskUploaded
+	return d.ledger.Update(*rec)
+}
+
+func (d *daemon) submit(ctx context.Context, job *pipelineJob) error {
+	rec := &job.rec
+	upload := rec.Uploads[job.supplier.store.Name()]
+	task := rec.Task
+	task.InputParam = upload.InputParam
+	task.VerifyParam = upload.VerifyParam
+
+	// the copies sent are written to the ledger once the loop stops rather than per copy, after
+	// a crash the hub answers the copies it already has as duplicates
+	submitted := rec.Submitted
+	for rec.Submitted < rec.Copies {
+		task.Name = rec.TaskDir + strconv.Itoa(rec.Submitted)
+		err := d.hubClient().Submit(ctx, task)
+		hubSubmissions.WithLabelValues(submitStatus(err)).Inc()
+		switch {
+		case errors.Is(err, ErrTaskDuplicate):
+			log.Warnf("task %s already exists on hub, skipping it", task.Name)
+		case errors.Is(err, ErrTaskRejected):
+			rec.Status = TaskRejected
+			if uerr := d.ledger.Update(*rec); uerr != nil {
+				return uerr
+			}
+			os.RemoveAll(rec.RootDir)
+			return xerrors.Errorf("submitting %s: %w", task.Name, err)
+		case err != nil:
+			// throttled or failing hub, the task is resumed on a later tick
+			if rec.Submitted > submitted {
+				if uerr := d.ledger.Update(*rec); uerr != nil {
+					log.Errorf("Failed record submitted copies of task %s, error: %v", rec.Key(), uerr)
+				}
+			}
+			return xerrors.Errorf("submitting %s: %w", task.Name, err)
+		}
+		rec.Submitted++
+	}
+
+	rec.Status = TaskSubmitted
+	if err := d.ledger.Update(*rec); err != nil {
+		return err
+	}
+	os.RemoveAll(rec.RootDir)
+	log.Infof("task %s submitted, copies: %d", rec.Key(), rec.Copies)
+	return nil
+}
+
+func artifactsExist(artifacts []string) bool {
+	if len(artifacts) == 0 {
+		return false
+	}
+	for _, artifact := range artifacts {
+		if _, err := os.Stat(artifact); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *daemon) uploadArtifact(ctx context.Context, store utils.ArtifactStore, key, path string) string {
+	var result string
+
+	for i := 0; i < 3 && ctx.Err() == nil; i++ {
+		start := time.Now()
+		if err := store.Put(ctx, key, path); err != nil {
+			log.Errorf("Failed upload file to %s, error: %v", store.Name(), err)
+			uploadFailures.WithLabelValues(store.Name()).Inc()
+			d.stat.storeResult(store.Name(), err)
+			continue
+		}
+		url, err := store.URL(ctx, key)
+		if err != nil {
+			log.Errorf("Failed get %s url, error: %v", store.Name(), err)
+			uploadFailures.WithLabelValues(store.Name()).Inc()
+			d.stat.storeResult(store.Name(), err)
+			continue
+		}
+		uploadDuration.WithLabelValues(store.Name()).Observe(time.Since(start).Seconds())
+		d.stat.storeResult(store.Name(), nil)
+		result = url
+		break
+	}
+	return result
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/swanchain/ubi-benchmark/utils"
+)
+
+const testConfig = `
+[HUB]
+HUB_URL = "http://127.0.0.1"
+TASK_URL = "http://127.0.0.1"
+CHECK_INTERVAL = 1
+BATCH_NUM = 1
+[STORAGE]
+BACKENDS = ["local"]
+[LOCAL]
+DIR = "%s"
+[CHAIN]
+FOLLOW = "fake"
+CONFIDENCE = 2
+`
+
+func TestHeightBudgetFollowsChain(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(cfgPath, []byte(fmt.Sprintf(testConfig, dir)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	utils.SetConfigPath(cfgPath)
+	if err := utils.InitConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	ledger, err := OpenTaskLedger(filepath.Join(dir, "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := utils.NewFakeChain(10, 0)
+	d := &daemon{
+		chain:     chain,
+		ledger:    ledger,
+		stat:      newDaemonStatus(),
+		templates: []*sectorTemplate{{sectorType: 512}},
+	}
+	ctx := context.Background()
+
+	// the daemon starts at the usable head, CONFIDENCE epochs behind the chain
+	if err := ledger.SkipTo(512, 8); err != nil {
+		t.Fatal(err)
+	}
+	used := make(map[int64]bool)
+	reserve := func(wantBudget int64) {
+		t.Helper()
+		budget, err := d.heightBudget(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if budget[512] != wantBudget {
+			t.Fatalf("budget %d, want %d", budget[512], wantBudget)
+		}
+		head, _ := chain.ChainHeight(ctx)
+		for i := int64(0); i < budget[512]; i++ {
+			rec, err := ledger.Reserve(512, "local", "fil-c2/512M", Task{}, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Height > head-2 {
+				t.Fatalf("reserved height %d beyond usable head %d", rec.Height, head-2)
+			}
+			if used[rec.Height] {
+				t.Fatalf("height %d reserved twice", rec.Height)
+			}
+			used[rec.Height] = true
+		}
+	}
+
+	reserve(1) // height 8
+	reserve(0) // nothing new until the chain moves
+	chain.Advance(3)
+	reserve(3) // heights 9 to 11
+	reserve(0)
+	chain.Advance(1)
+	reserve(1)
+	if len(used) != 5 {
+		t.Fatalf("reserved %d heights, want 5", len(used))
+	}
+
+	// a ledger whose cursor points at a used height refuses to hand it out again
+	ledger.state.Cursors[512] = 9
+	if _, err := ledger.Reserve(512, "local", "fil-c2/512M", Task{}, 1); err == nil {
+		t.Fatal("height 9 reserved again")
+	}
+}
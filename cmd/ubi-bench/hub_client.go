@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/swanchain/ubi-benchmark/utils"
+	"golang.org/x/xerrors"
+)
+
+var (
+	ErrTaskRejected  = errors.New("task rejected by hub")
+	ErrTaskDuplicate = errors.New("task already exists on hub")
+	ErrHubThrottled  = errors.New("hub is throttling requests")
+	ErrHubServer     = errors.New("hub server error")
+	ErrUnauthorized  = errors.New("hub refused the daemon's credentials")
+)
+
+// HubError is returned for every non 200 response of the hub. Kind is one of the ErrTask*/ErrHub*
+// errors, so callers can use errors.Is to decide between retrying, skipping or stopping.
+type HubError struct {
+	Kind       error
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *HubError) Error() string {
+	return fmt.Sprintf("%s, status code: %d, body: %s", e.Kind, e.StatusCode, e.Body)
+}
+
+func (e *HubError) Unwrap() error {
+	return e.Kind
+}
+
+func (e *HubError) retryable() bool {
+	return e.Kind == ErrHubThrottled || e.Kind == ErrHubServer
+}
+
+// HubClient talks to the UBI hub. Requests that fail with a network error, a throttling
+// response or a server error are retried with exponential backoff and jitter.
+type HubClient struct {
+	submitUrl  string
+	statsUrl   string
+	authToken  string
+	hmacKeyId  string
+	hmacSecret []byte
+	client     *http.Client
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func NewHubClient(cfg utils.HUB) *HubClient {
+	c := &HubClient{
+		submitUrl:  cfg.HubUrl,
+		statsUrl:   cfg.TaskUrl,
+		authToken:  cfg.AuthToken,
+		hmacKeyId:  cfg.HmacKeyId,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		maxRetries: 5,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+	}
+	if cfg.HmacSecret != "" {
+		c.hmacSecret = []byte(cfg.HmacSecret)
+	}
+	if cfg.RequestTimeout > 0 {
+		c.client.Timeout = time.Duration(cfg.RequestTimeout) * time.Second
+	}
+	if cfg.MaxRetries > 0 {
+		c.maxRetries = cfg.MaxRetries
+	}
+	if cfg.RetryBackoff > 0 {
+		c.minBackoff = time.Duration(cfg.RetryBackoff) * time.Second
+	}
+	if cfg.RetryMaxBackoff > 0 {
+		c.maxBackoff = time.Duration(cfg.RetryMaxBackoff) * time.Second
+	}
+	if c.maxBackoff < c.minBackoff {
+		c.maxBackoff = c.minBackoff
+	}
+	return c
+}
+
+// Submit sends task to the hub. The idempotency key is derived from the task name, so a
+// retried submission is recognised by the hub as the same task.
+func (c *HubClient) Submit(ctx context.Context, task Task) error {
+	jsonData, err := json.Marshal(task)
+	if err != nil {
+		return xerrors.Errorf("JSON encoding failed: %w", err)
+	}
+	// the body is not logged, presigned artifact urls are credentials
+	log.Infof("submitting task %s, type: %d, resource: %d, source: %d", task.Name, task.Type, task.ResourceID, task.Source)
+
+	_, err = c.do(ctx, http.MethodPost, c.submitUrl, jsonData, idempotencyKey(task.Name))
+	if err != nil {
+		return err
+	}
+	log.Infof("Request successful, task: %s", task.Name)
+	return nil
+}
+
+// TaskStats returns the number of queued tasks per resource for source.
+func (c *HubClient) TaskStats(ctx context.Context, source int) (*TaskStats, error) {
+	taskUrl := c.statsUrl
+	if source != 0 {
+		taskUrl += "&source=" + strconv.Itoa(source)
+	}
+
+	body, err := c.do(ctx, http.MethodGet, taskUrl, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var taskStats TaskStats
+	if err := json.Unmarshal(body, &taskStats); err != nil {
+		return nil, xerrors.Errorf("Error response convet to json: %w", err)
+	}
+	return &taskStats, nil
+}
+
+func (c *HubClient) do(ctx context.Context, method, url string, body []byte, idemKey string) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			delay := c.backoff(attempt)
+			var hubErr *HubError
+			if errors.As(lastErr, &hubErr) && hubErr.RetryAfter > delay {
+				delay = hubErr.RetryAfter
+			}
+			log.Warnf("%s %s failed, retrying in %s (attempt %d/%d): %v", method, url, delay, attempt, c.maxRetries, lastErr)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		respBody, err := c.once(ctx, method, url, body, idemKey)
+		if err == nil {
+			return respBody, nil
+		}
+		lastErr = err
+
+		var hubErr *HubError
+		if errors.As(err, &hubErr) && !hubErr.retryable() {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *HubClient) once(ctx context.Context, method, url string, body []byte, idemKey string) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idemKey != "" {
+		req.Header.Set("Idempotency-Key", idemKey)
+	}
+	c.authorize(req, body, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("%s request failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, xerrors.Errorf("Error reading response body: %w", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return respBody, nil
+	}
+	return nil, classifyHubResponse(resp, respBody)
+}
+
+// authorize adds the configured credentials to req. With an HMAC secret the request is signed over
+// its method, path and query, a unix timestamp and the SHA-256 digest of the body, so the hub can
+// reject forged or replayed requests:
+//
+//	X-Ubi-Signature = hex(HMAC-SHA256(secret, method + "\n" + request-uri + "\n" + timestamp + "\n" + body-digest))
+func (c *HubClient) authorize(req *http.Request, body []byte, now time.Time) {
+	if c.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.authToken)
+	}
+	if len(c.hmacSecret) == 0 {
+		return
+	}
+
+	digest := sha256.Sum256(body)
+	bodyDigest := hex.EncodeToString(digest[:])
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	mac := hmac.New(sha256.New, c.hmacSecret)
+	mac.Write([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + timestamp + "\n" + bodyDigest))
+
+	if c.hmacKeyId != "" {
+		req.Header.Set("X-Ubi-Key-Id", c.hmacKeyId)
+	}
+	req.Header.Set("X-Ubi-Timestamp", timestamp)
+	req.Header.Set("X-Ubi-Content-Sha256", bodyDigest)
+	req.Header.Set("X-Ubi-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (c *HubClient) backoff(attempt int) time.Duration {
+	d := c.minBackoff << uint(attempt-1)
+	if d <= 0 || d > c.maxBackoff {
+		d = c.maxBackoff
+	}
+	// jitter in [d/2, d] keeps a fleet of daemons from retrying in lockstep
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func classifyHubResponse(resp *http.Response, body []byte) *HubError {
+	hubErr := &HubError{
+		StatusCode: resp.StatusCode,
+		Body:       strings.TrimSpace(string(body)),
+	}
+
+	// the status code decides, only a client error's body may still mark the task as a duplicate:
+	// a server error mentioning a duplicate key says nothing about whether the task was stored
+	msg := strings.ToLower(hubErr.Body)
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		hubErr.Kind = ErrTaskDuplicate
+	case resp.StatusCode == http.StatusTooManyRequests:
+		hubErr.Kind = ErrHubThrottled
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			hubErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		hubErr.Kind = ErrUnauthorized
+	case resp.StatusCode >= 500:
+		hubErr.Kind = ErrHubServer
+	case (resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity) &&
+		(strings.Contains(msg, "duplicate") || strings.Contains(msg, "already exist")):
+		hubErr.Kind = ErrTaskDuplicate
+	default:
+		hubErr.Kind = ErrTaskRejected
+	}
+	return hubErr
+}
+
+func idempotencyKey(taskName string) string {
+	sum := sha256.Sum256([]byte("ubi-task:" + taskName))
+	return hex.EncodeToString(sum[:16])
+}
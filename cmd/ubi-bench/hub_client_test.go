@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestClassifyHubResponse(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		body string
+		want error
+	}{
+		{http.StatusConflict, "", ErrTaskDuplicate},
+		{http.StatusBadRequest, "task name already exists", ErrTaskDuplicate},
+		{http.StatusUnprocessableEntity, "Duplicate entry 'fil-c2-1' for key 'name'", ErrTaskDuplicate},
+		{http.StatusBadRequest, "invalid resource id", ErrTaskRejected},
+		{http.StatusNotFound, "duplicate", ErrTaskRejected},
+		{http.StatusInternalServerError, "Error 1062: Duplicate entry 'fil-c2-1' for key 'name'", ErrHubServer},
+		{http.StatusBadGateway, "already exists", ErrHubServer},
+		{http.StatusUnauthorized, "duplicate session", ErrUnauthorized},
+		{http.StatusTooManyRequests, "duplicate request", ErrHubThrottled},
+	} {
+		err := classifyHubResponse(&http.Response{StatusCode: tc.code, Header: http.Header{}}, []byte(tc.body))
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%d %q: got %v, want %v", tc.code, tc.body, err.Kind, tc.want)
+		}
+	}
+}
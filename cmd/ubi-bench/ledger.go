@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	ledgerVersion = 1
+
+	// finished tasks are only kept so that operators can inspect them, heights below the
+	// cursor are never generated again
+	maxFinishedRecords = 1000
+)
+
+type TaskStatus string
+
+const (
+	TaskPending   TaskStatus = "pending"   // height reserved, Commit1 output not written yet
+	TaskGenerated TaskStatus = "generated" // artifacts are on disk
+	TaskUploaded  TaskStatus = "uploaded"  // artifacts are published to the task's store
+	TaskSubmitted TaskStatus = "submitted" // every copy was sent to the hub
+	TaskRejected  TaskStatus = "rejected"  // the hub refused the task, it is not retried
+	TaskFailed    TaskStatus = "failed"    // given up after PIPELINE.MAX_ATTEMPTS failed attempts
+)
+
+func (s TaskStatus) finished() bool {
+	return s == TaskSubmitted || s == TaskRejected || s == TaskFailed
+}
+
+type TaskUpload struct {
+	InputParam  string
+	VerifyParam string
+	UploadedAt  time.Time
+}
+
+type TaskRecord struct {
+	Height      int64
+	SectorType  int64 // 512 or 32, every sector type has its own heights
+	TaskDir     string
+	RootDir     string
+	Prefix      string // object key prefix, e.g. fil-c2/512M
+	Artifacts   []string
+	Store       string // artifact store the task is supplied through
+	Task        Task   // template sent to the hub, Name is set per copy
+	Copies      int
+	Submitted   int // number of copies already sent to the hub
+	Uploads     map[string]TaskUpload
+	Status      TaskStatus
+	Attempts    int       // failed attempts so far
+	NextAttempt time.Time // a failed task is not resumed before this time
+	LastError   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Key identifies the record in the ledger, heights of different sector types may overlap.
+func (r TaskRecord) Key() string {
+	return fmt.Sprintf("%d/%d", r.SectorType, r.Height)
+}
+
+type ledgerState struct {
+	Version int
+	Cursors map[int64]int64 // sector type -> first height that has not been reserved
+	Tasks   map[string]*TaskRecord
+}
+
+// TaskLedger is the daemon's on-disk record of reserved heights and the progress of every task
+// generated from them. Each change rewrites the ledger file atomically, so after a crash the
+// daemon resumes unfinished tasks instead of generating or submitting them again.
+type TaskLedger struct {
+	path string
+
+	lk    sync.Mutex
+	state ledgerState
+}
+
+func OpenTaskLedger(path string) (*TaskLedger, error) {
+	l := &TaskLedger{
+		path: path,
+		state: ledgerState{
+			Version: ledgerVersion,
+			Cursors: make(map[int64]int64),
+			Tasks:   make(map[string]*TaskRecord),
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("reading task ledger: %w", err)
+	}
+	if err := json.Unmarshal(data, &l.state); err != nil {
+		return nil, xerrors.Errorf("unmarshalling task ledger %s: %w", path, err)
+	}
+	if l.state.Version != ledgerVersion {
+		return nil, xerrors.Errorf("unsupported task ledger version %d", l.state.Version)
+	}
+	if l.state.Cursors == nil {
+		l.state.Cursors = make(map[int64]int64)
+	}
+	if l.state.Tasks == nil {
+		l.state.Tasks = make(map[string]*TaskRecord)
+	}
+	return l, nil
+}
+
+// NextHeight returns the first height of sectorType that has not been reserved yet, 0 if the
+// ledger has no cursor for it.
+func (l *TaskLedger) NextHeight(sectorType int64) int64 {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return l.cursor(sectorType)
+}
+
+// SkipTo moves the height cursor of sectorType forward to height. The cursor never moves backwards.
+func (l *TaskLedger) SkipTo(sectorType, height int64) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if height <= l.cursor(sectorType) {
+		return nil
+	}
+	l.state.Cursors[sectorType] = height
+	return l.flush()
+}
+
+// Reserve takes the next height of sectorType and records a pending task for it in a single write.
+func (l *TaskLedger) Reserve(sectorType int64, store, prefix string, task Task, copies int) (TaskRecord, error) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	now := time.Now()
+	rec := &TaskRecord{
+		Height:     l.cursor(sectorType),
+		SectorType: sectorType,
+		Prefix:     prefix,
+		Store:      store,
+		Task:       task,
+		Copies:     copies,
+		Uploads:    make(map[string]TaskUpload),
+		Status:     TaskPending,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if _, ok := l.state.Tasks[rec.Key()]; ok {
+		return TaskRecord{}, xerrors.Errorf("height %d of sector type %d is already used", rec.Height, sectorType)
+	}
+	l.state.Tasks[rec.Key()] = rec
+	l.state.Cursors[sectorType] = rec.Height + 1
+	if err := l.flush(); err != nil {
+		return TaskRecord{}, err
+	}
+	return *rec, nil
+}
+
+// Update replaces the record with rec's key.
+func (l *TaskLedger) Update(rec TaskRecord) error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	rec.UpdatedAt = time.Now()
+	l.state.Tasks[rec.Key()] = &rec
+	l.prune()
+	return l.flush()
+}
+
+// Fail records a failed attempt of the task with key. The task is resumed after backoff(attempts)
+// or, once it has failed maxAttempts times, marked failed. Finished tasks are left as they are.
+func (l *TaskLedger) Fail(key, reason string, maxAttempts int, backoff func(attempts int) time.Duration) (TaskRecord, error) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	rec, ok := l.state.Tasks[key]
+	if !ok {
+		return TaskRecord{}, xerrors.Errorf("task %s is not in the ledger", key)
+	}
+	if rec.Status.finished() {
+		return *rec, nil
+	}
+	now := time.Now()
+	rec.Attempts++
+	rec.LastError = reason
+	rec.UpdatedAt = now
+	if rec.Attempts >= maxAttempts {
+		rec.Status = TaskFailed
+	} else {
+		rec.NextAttempt = now.Add(backoff(rec.Attempts))
+	}
+	l.prune()
+	if err := l.flush(); err != nil {
+		return TaskRecord{}, err
+	}
+	return *rec, nil
+}
+
+// Unfinished returns every task that is not submitted, rejected or failed, lowest height first.
+func (l *TaskLedger) Unfinished() []TaskRecord {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	var recs []TaskRecord
+	for _, rec := range l.state.Tasks {
+		if !rec.Status.finished() {
+			recs = append(recs, *rec)
+		}
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].Height != recs[j].Height {
+			return recs[i].Height < recs[j].Height
+		}
+		return recs[i].SectorType < recs[j].SectorType
+	})
+	return recs
+}
+
+// Recent returns up to n tasks, most recently updated first.
+func (l *TaskLedger) Recent(n int) []TaskRecord {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	recs := make([]TaskRecord, 0, len(l.state.Tasks))
+	for _, rec := range l.state.Tasks {
+		recs = append(recs, *rec)
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].UpdatedAt.After(recs[j].UpdatedAt)
+	})
+	if len(recs) > n {
+		recs = recs[:n]
+	}
+	return recs
+}
+
+func (l *TaskLedger) cursor(sectorType int64) int64 {
+	return l.state.Cursors[sectorType]
+}
+
+func (l *TaskLedger) prune() {
+	var finished []*TaskRecord
+	for _, rec := range l.state.Tasks {
+		if rec.Status.finished() {
+			finished = append(finished, rec)
+		}
+	}
+	if len(finished) <= maxFinishedRecords {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].UpdatedAt.Before(finished[j].UpdatedAt)
+	})
+	for _, rec := range finished[:len(finished)-maxFinishedRecords] {
+		delete(l.state.Tasks, rec.Key())
+	}
+}
+
+func (l *TaskLedger) flush() error {
+	data, err := json.MarshalIndent(l.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return xerrors.Errorf("writing task ledger: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return xerrors.Errorf("writing task ledger: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return xerrors.Errorf("syncing task ledger: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return xerrors.Errorf("replacing task ledger: %w", err)
+	}
+
+	// make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(l.path)); err == nil {
+		_ = dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLedgerFailBacksOff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+	ledger, err := OpenTaskLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := ledger.Reserve(512, "local", "fil-c2/512M", Task{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pipeline{retryBackoff: time.Minute}
+
+	for attempt := 1; attempt < 3; attempt++ {
+		start := time.Now()
+		got, err := ledger.Fail(rec.Key(), "upload failed", 3, p.backoff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait := time.Minute << (attempt - 1)
+		if got.Status != TaskPending || got.Attempts != attempt || got.NextAttempt.Before(start.Add(wait)) {
+			t.Fatalf("attempt %d: %+v, want a retry after %s", attempt, got, wait)
+		}
+	}
+	got, err := ledger.Fail(rec.Key(), "upload failed", 3, p.backoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != TaskFailed || got.LastError != "upload failed" {
+		t.Fatalf("after the last attempt: %+v", got)
+	}
+
+	// failed tasks stay failed across restarts and are not resumed
+	ledger, err = OpenTaskLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recs := ledger.Unfinished(); len(recs) != 0 {
+		t.Fatalf("unfinished tasks: %+v", recs)
+	}
+	if got, _ := ledger.Fail(rec.Key(), "again", 3, p.backoff); got.Attempts != 3 {
+		t.Fatalf("a finished task counted another attempt: %+v", got)
+	}
+}
+
+func TestPipelineBackoffCapped(t *testing.T) {
+	p := &pipeline{retryBackoff: time.Minute}
+	for attempts, want := range map[int]time.Duration{1: time.Minute, 3: 4 * time.Minute, 7: maxRetryBackoff, 40: maxRetryBackoff} {
+		if got := p.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
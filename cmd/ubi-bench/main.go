@@ -4,16 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/fs"
-	"math/big"
-	"math/rand"
-	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/docker/go-units"
@@ -21,12 +18,10 @@ import (
 	"github.com/filecoin-project/go-paramfetch"
 	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
-	"github.com/filecoin-project/lotus/chain/types"
 	lcli "github.com/filecoin-project/lotus/cli"
 	"github.com/mitchellh/go-homedir"
 	"github.com/swanchain/ubi-benchmark/utils"
 	"github.com/urfave/cli/v2"
-	"golang.org/x/crypto/blake2b"
 
 	logging "github.com/ipfs/go-log/v2"
 	"golang.org/x/xerrors"
@@ -41,7 +36,6 @@ import (
 )
 
 var log = logging.Logger("ubi-bench")
-var latestHeight int64
 
 type BenchResults struct {
 	EnvVar map[string]string
@@ -51,8 +45,13 @@ type BenchResults struct {
 
 	SealingSum     SealingResult
 	SealingResults []SealingResult
+	WallTime       time.Duration // from the first AddPiece to the last sector finishing, phases overlap
+	ResourceNote   string        `json:",omitempty"` // how the resources of overlapping phases were split
 }
 
+const overlapNote = "phases of different sectors ran at the same time: the cpu time and io of every second are " +
+	"split evenly between the phases running in it, peak memory and temp disk are those of the whole process"
+
 func (bo *BenchResults) SumSealingTime() error {
 	if len(bo.SealingResults) <= 0 {
 		return xerrors.Errorf("BenchResults SealingResults len <= 0")
@@ -65,14 +64,48 @@ func (bo *BenchResults) SumSealingTime() error {
 		bo.SealingSum.AddPiece += sealing.AddPiece
 		bo.SealingSum.PreCommit1 += sealing.PreCommit1
 		bo.SealingSum.PreCommit2 += sealing.PreCommit2
+		bo.SealingSum.Commit1 += sealing.Commit1
+		bo.SealingSum.Commit2 += sealing.Commit2
+		bo.SealingSum.Verify += sealing.Verify
+		bo.SealingSum.AddPieceWait += sealing.AddPieceWait
+		bo.SealingSum.PreCommit1Wait += sealing.PreCommit1Wait
+		bo.SealingSum.PreCommit2Wait += sealing.PreCommit2Wait
+		bo.SealingSum.Commit1Wait += sealing.Commit1Wait
+		bo.SealingSum.Commit2Wait += sealing.Commit2Wait
+		bo.SealingSum.VerifyWait += sealing.VerifyWait
+		for phase, usage := range sealing.Resources {
+			if bo.SealingSum.Resources == nil {
+				bo.SealingSum.Resources = make(map[string]ResourceUsage)
+			}
+			sum := bo.SealingSum.Resources[phase]
+			sum.add(usage)
+			bo.SealingSum.Resources[phase] = sum
+		}
 	}
 	return nil
 }
 
+// proofEnvVars are the environment variables of the proofs library that change benchmark results.
+var proofEnvVars = []string{"BELLMAN_NO_GPU", "FIL_PROOFS_USE_GPU_COLUMN_BUILDER",
+	"FIL_PROOFS_USE_GPU_TREE_BUILDER", "FIL_PROOFS_USE_MULTICORE_SDR", "BELLMAN_CUSTOM_GPU"}
+
 type SealingResult struct {
 	AddPiece   time.Duration
 	PreCommit1 time.Duration
 	PreCommit2 time.Duration
+	Commit1    time.Duration `json:",omitempty"` // commit phases are only run with --commit
+	Commit2    time.Duration `json:",omitempty"`
+	Verify     time.Duration `json:",omitempty"`
+
+	Resources map[string]ResourceUsage `json:",omitempty"` // by phase
+
+	// time the sector waited for a free worker of each phase
+	AddPieceWait   time.Duration
+	PreCommit1Wait time.Duration
+	PreCommit2Wait time.Duration
+	Commit1Wait    time.Duration `json:",omitempty"`
+	Commit2Wait    time.Duration `json:",omitempty"`
+	VerifyWait     time.Duration `json:",omitempty"`
 }
 
 type Commit2In struct {
@@ -101,6 +134,18 @@ func main() {
 		Usage:                     "Benchmark performance of ubi on your hardware",
 		Version:                   "v0.0.1",
 		DisableSliceFlagSeparator: true,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "path to the config file",
+				Value:   "config.toml",
+				EnvVars: []string{"UBI_CONFIG"},
+			},
+		},
+		Before: func(c *cli.Context) error {
+			utils.SetConfigPath(c.String("config"))
+			return nil
+		},
 		Commands: []*cli.Command{
 			sealCmd,
 			seedCmd,
@@ -110,6 +155,10 @@ func main() {
 			batchC1Cmd,
 			uploadC1Cmd,
 			daemonCmd,
+			configCmd,
+			benchCmd,
+			probeCmd,
+			serveVerifyCmd,
 		},
 	}
 
@@ -153,11 +202,43 @@ var sealCmd = &cli.Command{
 			Usage: "select number of sectors to seal",
 			Value: 1,
 		},
+		&cli.IntFlag{
+			Name:  "addpiece-parallel",
+			Usage: "sectors in AddPiece at once",
+			Value: 1,
+		},
 		&cli.IntFlag{
 			Name:  "parallel",
-			Usage: "num run in parallel",
+			Usage: "sectors in PreCommit1 at once",
 			Value: 1,
 		},
+		&cli.IntFlag{
+			Name:  "pc2-parallel",
+			Usage: "sectors in PreCommit2 at once",
+			Value: 1,
+		},
+		&cli.IntFlag{
+			Name:  "c1-parallel",
+			Usage: "sectors in Commit1 at once, with --commit",
+			Value: 1,
+		},
+		&cli.IntFlag{
+			Name:  "c2-parallel",
+			Usage: "sectors in Commit2 at once, with --commit",
+			Value: 1,
+		},
+		&cli.BoolFlag{
+			Name:  "commit",
+			Usage: "continue with Commit1, Commit2 and verifying the proof of every sector",
+		},
+		&cli.BoolFlag{
+			Name:  "json-out",
+			Usage: "print the result record as json",
+		},
+		&cli.StringFlag{
+			Name:  "results-dir",
+			Usage: "directory the result record is saved in for `ubi-bench bench compare`, defaults to results in the storage directory",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		if c.Bool("no-gpu") {
@@ -222,10 +303,20 @@ var sealCmd = &cli.Command{
 		var sealedSectors []prooftypes.SectorInfo
 
 		parCfg := ParCfg{
+			AddPiece:   c.Int("addpiece-parallel"),
 			PreCommit1: c.Int("parallel"),
-			PreCommit2: 1,
+			PreCommit2: c.Int("pc2-parallel"),
+			Commit:     c.Bool("commit"),
+			Commit1:    c.Int("c1-parallel"),
+			Commit2:    c.Int("c2-parallel"),
+		}
+		if parCfg.Commit {
+			if err := paramfetch.GetParams(lcli.ReqContext(c), build.ParametersJSON(), build.SrsJSON(), uint64(sectorSize)); err != nil {
+				return xerrors.Errorf("getting params: %w", err)
+			}
 		}
-		sealTimings, extendedSealedSectors, err = runSeals(sb, sectorNumber, parCfg, mid, sectorSize, []byte(c.String("ticket-preimage")), sbdir)
+		sealStart := time.Now()
+		sealTimings, extendedSealedSectors, err = runSeals(c.Context, sb, sectorNumber, parCfg, mid, sectorSize, []byte(c.String("ticket-preimage")), sbdir)
 		if err != nil {
 			return xerrors.Errorf("failed to run seals: %w", err)
 		}
@@ -241,28 +332,49 @@ var sealCmd = &cli.Command{
 			SectorSize:     sectorSize,
 			SectorNumber:   sectorNumber,
 			SealingResults: sealTimings,
+			WallTime:       time.Since(sealStart),
+		}
+		if sectorNumber > 1 {
+			bo.ResourceNote = overlapNote
 		}
 		if err := bo.SumSealingTime(); err != nil {
 			return err
 		}
 
 		bo.EnvVar = make(map[string]string)
-		for _, envKey := range []string{"BELLMAN_NO_GPU", "FIL_PROOFS_USE_GPU_COLUMN_BUILDER",
-			"FIL_PROOFS_USE_GPU_TREE_BUILDER", "FIL_PROOFS_USE_MULTICORE_SDR", "BELLMAN_CUSTOM_GPU"} {
+		for _, envKey := range proofEnvVars {
 			envValue, found := os.LookupEnv(envKey)
 			if found {
 				bo.EnvVar[envKey] = envValue
 			}
 		}
 
+		rec := &BenchRecord{
+			Version:      benchRecordVersion,
+			Created:      time.Now(),
+			Hardware:     collectHardware(),
+			Concurrency:  parCfg,
+			BenchResults: bo,
+		}
+		resultsDir := c.String("results-dir")
+		if resultsDir == "" {
+			resultsDir = filepath.Join(sdir, "results")
+		}
+		recPath := filepath.Join(resultsDir, fmt.Sprintf("seal-%s-%s.json", sectorSize.ShortString(), rec.Created.Format("20060102-150405")))
+		if err := writeBenchRecord(recPath, rec); err != nil {
+			return xerrors.Errorf("saving results: %w", err)
+		}
+		log.Infof("results saved to %s", recPath)
+
 		if c.Bool("json-out") {
-			data, err := json.MarshalIndent(bo, "", "  ")
+			data, err := json.MarshalIndent(rec, "", "  ")
 			if err != nil {
 				return err
 			}
 
 			fmt.Println(string(data))
 		} else {
+			fmt.Printf("hardware: %s\n", rec.Hardware)
 			fmt.Println("environment variable list:")
 			for envKey, envValue := range bo.EnvVar {
 				fmt.Printf("%s=%s\n", envKey, envValue)
@@ -271,146 +383,35 @@ var sealCmd = &cli.Command{
 			fmt.Printf("seal: addPiece: %s (%s)\n", bo.SealingSum.AddPiece, bps(bo.SectorSize, bo.SectorNumber, bo.SealingSum.AddPiece))
 			fmt.Printf("seal: preCommit phase 1: %s (%s)\n", bo.SealingSum.PreCommit1, bps(bo.SectorSize, bo.SectorNumber, bo.SealingSum.PreCommit1))
 			fmt.Printf("seal: preCommit phase 2: %s (%s)\n", bo.SealingSum.PreCommit2, bps(bo.SectorSize, bo.SectorNumber, bo.SealingSum.PreCommit2))
+			if parCfg.Commit {
+				fmt.Printf("seal: commit phase 1: %s (%s)\n", bo.SealingSum.Commit1, bps(bo.SectorSize, bo.SectorNumber, bo.SealingSum.Commit1))
+				fmt.Printf("seal: commit phase 2: %s (%s)\n", bo.SealingSum.Commit2, bps(bo.SectorSize, bo.SectorNumber, bo.SealingSum.Commit2))
+				fmt.Printf("seal: verify: %s (%s)\n", bo.SealingSum.Verify, bps(bo.SectorSize, bo.SectorNumber, bo.SealingSum.Verify))
+			}
+			fmt.Printf("seal: queue wait: addPiece %s, preCommit phase 1 %s, preCommit phase 2 %s", bo.SealingSum.AddPieceWait, bo.SealingSum.PreCommit1Wait, bo.SealingSum.PreCommit2Wait)
+			if parCfg.Commit {
+				fmt.Printf(", commit phase 1 %s, commit phase 2 %s, verify %s", bo.SealingSum.Commit1Wait, bo.SealingSum.Commit2Wait, bo.SealingSum.VerifyWait)
+			}
+			fmt.Printf("\nseal: wall time: %s (%s)\n", bo.WallTime, bps(bo.SectorSize, bo.SectorNumber, bo.WallTime))
+			for _, phase := range []string{"addPiece", "preCommit1", "preCommit2", "commit1", "commit2", "verify"} {
+				if usage, ok := bo.SealingSum.Resources[phase]; ok {
+					fmt.Printf("seal: resources %s: %s\n", phase, usage)
+				}
+			}
+			if bo.ResourceNote != "" {
+				fmt.Printf("seal: note: %s\n", bo.ResourceNote)
+			}
 			fmt.Println("")
 		}
 		return nil
 	},
 }
 
-type ParCfg struct {
-	PreCommit1 int
-	PreCommit2 int
-}
-
-func runSeals(sb *ffiwrapper.Sealer, numSectors int, par ParCfg, mid abi.ActorID, sectorSize abi.SectorSize, ticketPreimage []byte, sbdir string) ([]SealingResult, []prooftypes.ExtendedSectorInfo, error) {
-	var pieces []abi.PieceInfo
-	sealTimings := make([]SealingResult, numSectors)
-	sealedSectors := make([]prooftypes.ExtendedSectorInfo, numSectors)
-
-	preCommit2Sema := make(chan struct{}, par.PreCommit2)
-
-	if numSectors%par.PreCommit1 != 0 {
-		return nil, nil, fmt.Errorf("parallelism factor must cleanly divide numSectors")
-	}
-	for i := abi.SectorNumber(0); i < abi.SectorNumber(numSectors); i++ {
-		sid := storiface.SectorRef{
-			ID: abi.SectorID{
-				Miner:  mid,
-				Number: i,
-			},
-			ProofType: spt(sectorSize, false),
-		}
-
-		start := time.Now()
-		log.Infof("[%d] Writing piece into sector...", i)
-
-		r := rand.New(rand.NewSource(100 + int64(i)))
-
-		pi, err := sb.AddPiece(context.TODO(), sid, nil, abi.PaddedPieceSize(sectorSize).Unpadded(), r)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		pieces = append(pieces, pi)
-
-		sealTimings[i].AddPiece = time.Since(start)
-	}
-
-	sectorsPerWorker := numSectors / par.PreCommit1
-
-	errs := make(chan error, par.PreCommit1)
-	for wid := 0; wid < par.PreCommit1; wid++ {
-		go func(worker int) {
-			sealerr := func() error {
-				start := worker * sectorsPerWorker
-				end := start + sectorsPerWorker
-				for i := abi.SectorNumber(start); i < abi.SectorNumber(end); i++ {
-					sid := storiface.SectorRef{
-						ID: abi.SectorID{
-							Miner:  mid,
-							Number: i,
-						},
-						ProofType: spt(sectorSize, false),
-					}
-
-					start := time.Now()
-
-					trand := blake2b.Sum256(ticketPreimage)
-					ticket := abi.SealRandomness(trand[:])
-
-					log.Infof("[%d] Running replication(1)...", i)
-					piece := []abi.PieceInfo{pieces[i]}
-					pc1o, err := sb.SealPreCommit1(context.TODO(), sid, ticket, piece)
-					if err != nil {
-						return xerrors.Errorf("commit: %w", err)
-					}
-
-					precommit1 := time.Now()
-
-					preCommit2Sema <- struct{}{}
-					pc2Start := time.Now()
-					log.Infof("[%d] Running replication(2)...", i)
-					cids, err := sb.SealPreCommit2(context.TODO(), sid, pc1o)
-					if err != nil {
-						return xerrors.Errorf("commit: %w", err)
-					}
-
-					precommit2 := time.Now()
-					<-preCommit2Sema
-
-					sealedSectors[i] = prooftypes.ExtendedSectorInfo{
-						SealProof:    sid.ProofType,
-						SectorNumber: i,
-						SealedCID:    cids.Sealed,
-						SectorKey:    nil,
-					}
-
-					log.Infof("[%d] Generating Commit1 for sector:", i)
-
-					var c1in = new(Commit1In)
-					c1in.Sid = sid
-					c1in.Ticket = ticket
-					c1in.Piece = piece
-					c1in.Cids = cids
-					c1in.SectorSize = sectorSize
-					bytes, err := json.Marshal(c1in)
-					if err != nil {
-						return err
-					}
-
-					fileName := filepath.Join(filepath.Dir(sbdir), fmt.Sprintf("c1in-%d-%s.json", mid, i.String()))
-					if err = os.WriteFile(fileName, bytes, 0644); err != nil {
-						return err
-					}
-
-					sealTimings[i].PreCommit1 = precommit1.Sub(start)
-					sealTimings[i].PreCommit2 = precommit2.Sub(pc2Start)
-				}
-				return nil
-			}()
-			if sealerr != nil {
-				errs <- sealerr
-				return
-			}
-			errs <- nil
-		}(wid)
-	}
-
-	for i := 0; i < par.PreCommit1; i++ {
-		err := <-errs
-		if err != nil {
-			return nil, nil, err
-		}
-	}
-
-	return sealTimings, sealedSectors, nil
-}
-
 var seedCmd = &cli.Command{
 	Name:   "seed",
 	Usage:  "Generate random numbers",
 	Hidden: true,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "miner-addr",
 			Usage: "miner address",
@@ -420,7 +421,7 @@ var seedCmd = &cli.Command{
 			Name:  "height",
 			Usage: "specify a height",
 		},
-	},
+	}, randomnessFlags...),
 	Action: func(c *cli.Context) error {
 		height := c.Int64("height")
 		if height == 0 {
@@ -432,7 +433,12 @@ var seedCmd = &cli.Command{
 			return err
 		}
 
-		randomness, err := utils.GetRandomness(maddr, crypto.DomainSeparationTag_InteractiveSealChallengeSeed, height)
+		source, err := randomnessSource(c)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		randomness, err := source.GetRandomness(c.Context, maddr, crypto.DomainSeparationTag_InteractiveSealChallengeSeed, height)
 		if err != nil {
 			return err
 		}
@@ -446,7 +452,7 @@ var c1Cmd = &cli.Command{
 	Usage:     "execute Commit1 task",
 	ArgsUsage: "[input.json]",
 	Hidden:    true,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "storage-dir",
 			Usage: "path to the storage directory that will store sectors long term",
@@ -455,7 +461,7 @@ var c1Cmd = &cli.Command{
 			Name:  "height",
 			Usage: "specify a height",
 		},
-	},
+	}, randomnessFlags...),
 	Action: func(c *cli.Context) error {
 		if !c.Args().Present() {
 			return xerrors.Errorf("Usage: ubi-bench c1 [input.json]")
@@ -492,7 +498,12 @@ var c1Cmd = &cli.Command{
 			return err
 		}
 
-		randomness, err := utils.GetRandomness(maddr, crypto.DomainSeparationTag_InteractiveSealChallengeSeed, height)
+		source, err := randomnessSource(c)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		randomness, err := source.GetRandomness(c.Context, maddr, crypto.DomainSeparationTag_InteractiveSealChallengeSeed, height)
 		if err != nil {
 			return err
 		}
@@ -584,12 +595,15 @@ var c2Cmd = &cli.Command{
 		}
 
 		start := time.Now()
+		sampler := startSampler("")
 		proof, err := sb.SealCommit2(context.TODO(), c2in.Sid, c2in.Phase1Out)
-		log.Info("proof: %v", proof)
+		usage := sampler.Stop()
+		log.Debugf("proof: %x", proof)
 		if err != nil {
 			return err
 		}
 		totalTime := time.Since(start)
+		log.Infof("seal: commit phase 2 resources: %s", usage)
 		svi := prooftypes.SealVerifyInfo{
 			SectorID:              c2in.Sid.ID,
 			SealedCID:             c2in.Cids.Sealed,
@@ -600,17 +614,17 @@ var c2Cmd = &cli.Command{
 			InteractiveRandomness: c2in.Seed.Value,
 			UnsealedCID:           c2in.Cids.Unsealed,
 		}
-		c2OutBytes, err := json.Marshal(svi)
+		c2OutBytes, err := json.Marshal(C2Proof{SealVerifyInfo: svi, SeedEpoch: int64(c2in.Seed.Epoch)})
 		if err != nil {
 			return err
 		}
-		log.Info("c2OutBytes: %v", string(c2OutBytes))
+		log.Debugf("c2 output: %s", c2OutBytes)
 		c2JsonFile := filepath.Join(filepath.Dir(sdir), fmt.Sprintf("c2-%d-%d-%d.json", c2in.Sid.ID.Miner, c2in.Sid.ID.Number, c2in.Seed.Epoch))
 		if err = os.WriteFile(c2JsonFile, c2OutBytes, 0666); err != nil {
 			return err
 		}
 
-		log.Info("seal: commit phase 2 finished, total time: %f, sector_id: %d \n", totalTime.Seconds(), c2in.SectorNum)
+		log.Infof("seal: commit phase 2 finished, total time: %f, sector_id: %d", totalTime.Seconds(), c2in.SectorNum)
 		return nil
 	},
 }
@@ -620,7 +634,7 @@ var batchC1Cmd = &cli.Command{
 	Usage:     "execute batch Commit1 task",
 	ArgsUsage: "[input.json]",
 	Hidden:    true,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "storage-dir",
 			Usage: "path to the storage directory that will store sectors long term",
@@ -634,7 +648,7 @@ var batchC1Cmd = &cli.Command{
 			Usage: "number of batches generated",
 			Value: 1,
 		},
-	},
+	}, randomnessFlags...),
 	Action: func(c *cli.Context) error {
 		if !c.Args().Present() {
 			return xerrors.Errorf("Usage: ubi-bench batch [input.json]")
@@ -672,8 +686,13 @@ var batchC1Cmd = &cli.Command{
 			return err
 		}
 
+		source, err := randomnessSource(c)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
 		for i := 0; i < num; i++ {
-			_, _, err := generaC1Out(maddr, sb, sdir, c1in, height+int64(i))
+			_, _, err := generaC1Out(c.Context, source, maddr, sb, sdir, c1in, height+int64(i))
 			if err != nil {
 				return err
 			}
@@ -703,6 +722,7 @@ var uploadC1Cmd = &cli.Command{
 			return err
 		}
 
+		utils.RequireHub()
 		if err := utils.InitConfig(); err != nil {
 			return err
 		}
@@ -716,6 +736,7 @@ var uploadC1Cmd = &cli.Command{
 		}
 
 		var count int
+		hub := NewHubClient(utils.GetConfig().HUB)
 		storageService := utils.NewStorageService()
 		err := filepath.WalkDir(c1Dir, func(path string, d fs.DirEntry, err error) error {
 			split := strings.Split(d.Name(), "-")
@@ -779,7 +800,9 @@ var uploadC1Cmd = &cli.Command{
 						ResourceID:  resourceId,
 					}
 				}
-				DoSend(task)
+				if err := hub.Submit(c.Context, task); err != nil {
+					log.Errorf("Failed submit task %s, error: %v", task.Name, err)
+				}
 				count++
 				fmt.Println("==============")
 			}
@@ -796,39 +819,72 @@ var uploadC1Cmd = &cli.Command{
 
 var daemonCmd = &cli.Command{
 	Name:      "daemon",
-	Usage:     "Auto generate c1 out and upload the results of c1 to mcs",
-	ArgsUsage: "[c1in-input.json]",
+	Usage:     "Auto generate c1 out and upload the results of c1 to the configured storage backends",
+	ArgsUsage: "[c1in-input.json...]",
+	Description: "Every input file is the Commit1In template of a sealed sector in --storage-dir, at most one\n" +
+		"per sector type. A 512MiB template supplies CPU512/GPU512 tasks, a 32GiB template CPU32G/GPU32G\n" +
+		"tasks. Each sector type walks its own heights.",
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:  "storage-dir",
 			Usage: "path to the storage directory that will store sectors long term",
 		},
-		&cli.Int64Flag{
+		&cli.StringSliceFlag{
 			Name:  "last-height",
-			Usage: "specify a height",
+			Usage: "height to start from, only needed on the first run or to skip heights forward; <height> applies to every sector type, <sector-type>=<height> to one of them; not allowed when following a chain with CHAIN.FOLLOW",
 		},
 		&cli.Int64Flag{
 			Name:  "sector-type",
-			Usage: "512 or 32",
+			Usage: "512 or 32, only accept input files of this sector type",
+		},
+		&cli.StringFlag{
+			Name:  "ledger",
+			Usage: "path to the task ledger file, defaults to ubi-task-ledger.json next to the storage directory",
+		},
+		&cli.DurationFlag{
+			Name:  "watch-config",
+			Usage: "how often to check the config file for changes and apply them, 0 to only reload on SIGHUP",
+			Value: 10 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "drain-timeout",
+			Usage: "how long to wait for tasks in flight on SIGINT or SIGTERM before aborting them",
+			Value: 5 * time.Minute,
 		},
 	},
 	Action: func(c *cli.Context) error {
 		if !c.Args().Present() {
-			return xerrors.Errorf("Usage: ubi-bench batch [input.json]")
+			return xerrors.Errorf("Usage: ubi-bench daemon [c1in-input.json...]")
 		}
 
-		height := c.Int64("last-height")
-		if height == 0 {
-			return fmt.Errorf("must be specify a last-height")
+		sectorType := c.Int64("sector-type")
+		if sectorType != 0 && sectorType != 512 && sectorType != 32 {
+			return fmt.Errorf("sector-type value is wrong")
 		}
 
-		sectorType := c.Int64("sector-type")
-		if sectorType == 0 {
-			return fmt.Errorf("must be specify a sector-type")
+		var templates []*sectorTemplate
+		for _, path := range c.Args().Slice() {
+			tmpl, err := loadSectorTemplate(path)
+			if err != nil {
+				return err
+			}
+			if sectorType != 0 && tmpl.sectorType != sectorType {
+				return fmt.Errorf("input file %s is not a %d sector", path, sectorType)
+			}
+			for _, other := range templates {
+				if other.sectorType == tmpl.sectorType {
+					return fmt.Errorf("input file %s: more than one template of sector type %d", path, tmpl.sectorType)
+				}
+				if other.c1in.Sid.ID == tmpl.c1in.Sid.ID {
+					return fmt.Errorf("input file %s: sector %v is used by another template", path, tmpl.c1in.Sid.ID)
+				}
+			}
+			templates = append(templates, tmpl)
 		}
 
-		if sectorType != 512 && sectorType != 32 {
-			return fmt.Errorf("sector-type value is wrong")
+		heights, err := parseLastHeights(c.StringSlice("last-height"))
+		if err != nil {
+			return err
 		}
 
 		sdir := c.String("storage-dir")
@@ -843,59 +899,209 @@ var daemonCmd = &cli.Command{
 			return err
 		}
 
-		inb, err := os.ReadFile(c.Args().First())
-		if err != nil {
-			return xerrors.Errorf("reading input file: %w", err)
+		utils.RequireHub()
+		if err := utils.InitConfig(); err != nil {
+			return err
 		}
-		var c1in Commit1In
-		if err := json.Unmarshal(inb, &c1in); err != nil {
-			return xerrors.Errorf("unmarshalling input file: %w", err)
+
+		ledgerPath := c.String("ledger")
+		if ledgerPath == "" {
+			ledgerPath = filepath.Join(filepath.Dir(sdir), "ubi-task-ledger.json")
+		}
+		ledger, err := OpenTaskLedger(ledgerPath)
+		if err != nil {
+			return err
 		}
 
-		maddr, err := address.NewFromString("t0" + c1in.Sid.ID.Miner.String())
+		// when following a chain every sector type continues at the usable head, heights below
+		// the ledger's cursors are never handed out again
+		chain, err := utils.NewChainHead(c.Context, utils.GetConfig())
 		if err != nil {
 			return err
 		}
+		if chain != nil {
+			defer chain.Close()
+			if c.IsSet("last-height") {
+				return fmt.Errorf("--last-height cannot be used while following a chain, heights come from CHAIN.FOLLOW")
+			}
+			head, err := chain.ChainHeight(c.Context)
+			if err != nil {
+				return err
+			}
+			usable := max(head-utils.GetConfig().CHAIN.Confidence, 0)
+			log.Infof("following %s chain, head: %d, usable height: %d", chain.Name(), head, usable)
+			heights = map[int64]int64{0: usable}
+		}
 
-		if err := utils.InitConfig(); err != nil {
+		for _, tmpl := range templates {
+			height, ok := heights[tmpl.sectorType]
+			if !ok {
+				height = heights[0]
+			}
+			if chain == nil && height == 0 && ledger.NextHeight(tmpl.sectorType) == 0 {
+				return fmt.Errorf("must be specify a last-height for sector type %d", tmpl.sectorType)
+			}
+			if next := ledger.NextHeight(tmpl.sectorType); height != 0 && height < next {
+				log.Warnf("heights of sector type %d below %d are already used, not going back to %d", tmpl.sectorType, next, height)
+			}
+			if err := ledger.SkipTo(tmpl.sectorType, height); err != nil {
+				return err
+			}
+			log.Infof("task ledger: %s, sector type: %d, next height: %d", ledgerPath, tmpl.sectorType, ledger.NextHeight(tmpl.sectorType))
+			nextHeight.WithLabelValues(strconv.FormatInt(tmpl.sectorType, 10)).Set(float64(ledger.NextHeight(tmpl.sectorType)))
+		}
+
+		suppliers, err := newTaskSuppliers()
+		if err != nil {
 			return err
 		}
+		randomness, err := utils.NewRandomnessSource(c.Context, utils.GetConfig().RANDOMNESS)
+		if err != nil {
+			return err
+		}
+		defer randomness.Close()
+		log.Infof("randomness source: %s", randomness.Name())
+
+		// SIGINT and SIGTERM stop the daemon from taking new tasks, the servers and workers keep
+		// running on workCtx until the pipeline is drained
+		ctx, stop := signal.NotifyContext(c.Context, syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		workCtx, cancelWork := context.WithCancel(context.Background())
+		defer cancelWork()
+
+		for _, supplier := range suppliers {
+			localStore, ok := supplier.store.(*utils.LocalStore)
+			if !ok || utils.GetConfig().LOCAL.Listen == "" {
+				continue
+			}
+			go func() {
+				if err := localStore.ListenAndServe(workCtx, utils.GetConfig().LOCAL.Listen); err != nil {
+					log.Errorf("local artifact server stopped: %v", err)
+				}
+			}()
+		}
+
+		d := &daemon{
+			sealer:     sb,
+			sdir:       sdir,
+			templates:  templates,
+			suppliers:  suppliers,
+			randomness: randomness,
+			chain:      chain,
+			ledger:     ledger,
+			hub:        NewHubClient(utils.GetConfig().HUB),
+			policy:     newReplenishPolicy(utils.GetConfig().POLICY),
+			stat:       newDaemonStatus(),
+		}
+		d.pipeline = newPipeline(d, utils.GetConfig().PIPELINE)
+		d.pipeline.start(workCtx)
+		d.resume()
+
+		serveAPI := func(addr string, metrics, status bool) {
+			go func() {
+				if err := serveDaemonAPI(workCtx, addr, d, metrics, status); err != nil {
+					log.Errorf("daemon api server stopped: %v", err)
+				}
+			}()
+		}
+		metricsAddr, statusAddr := utils.GetConfig().METRICS.Listen, utils.GetConfig().STATUS.Listen
+		if metricsAddr != "" && metricsAddr == statusAddr {
+			serveAPI(metricsAddr, true, true)
+		} else {
+			if metricsAddr != "" {
+				serveAPI(metricsAddr, true, false)
+			}
+			if statusAddr != "" {
+				serveAPI(statusAddr, false, true)
+			}
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+
+		changed := make(chan struct{}, 1)
+		if interval := c.Duration("watch-config"); interval > 0 {
+			go utils.WatchConfig(workCtx, interval, func() {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			})
+		}
 
 		ticker := time.NewTicker(time.Duration(utils.GetConfig().HUB.CheckInterval) * time.Minute)
 		defer ticker.Stop()
 
-		latestHeight = height
 		for {
 			select {
-			case <-ticker.C:
-				checkTaskCountByMcs(maddr, sb, sdir, c1in, latestHeight, sectorType)
-				if utils.GetConfig().HUB.ENABLE_TITAN == 1 {
-					checkTaskCountByTiTan(maddr, sb, sdir, c1in, latestHeight+1, sectorType)
+			case <-ctx.Done():
+				drainTimeout := c.Duration("drain-timeout")
+				log.Infof("shutting down, waiting up to %s for tasks in flight", drainTimeout)
+				if !d.pipeline.drain(drainTimeout) {
+					log.Warnf("tasks still in flight after %s, aborting them, they are resumed on the next run", drainTimeout)
 				}
+				cancelWork()
+				if !d.pipeline.wait(30 * time.Second) {
+					log.Warnf("pipeline workers did not stop in time")
+				}
+				log.Infof("daemon stopped")
+				return nil
+			case <-hup:
+				log.Infof("received SIGHUP, reloading config")
+				d.reload(ticker)
+			case <-changed:
+				log.Infof("config file changed, reloading config")
+				d.reload(ticker)
+			case <-ticker.C:
+				d.tick(ctx)
 			}
 		}
 	},
 }
 
+// parseLastHeights parses the --last-height values, a plain height is returned for sector type 0.
+func parseLastHeights(values []string) (map[int64]int64, error) {
+	heights := make(map[int64]int64)
+	for _, value := range values {
+		var sectorType int64
+		if typ, height, ok := strings.Cut(value, "="); ok {
+			var err error
+			sectorType, err = strconv.ParseInt(typ, 10, 64)
+			if err != nil || (sectorType != 512 && sectorType != 32) {
+				return nil, fmt.Errorf("last-height %q: sector type must be 512 or 32", value)
+			}
+			value = height
+		}
+		height, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("last-height %q: %w", value, err)
+		}
+		heights[sectorType] = height
+	}
+	return heights, nil
+}
+
 var verifyCmd = &cli.Command{
 	Name:      "verify",
 	Usage:     "Verify a proof computation",
 	ArgsUsage: "[input.json]",
-	Flags: []cli.Flag{
+	Description: "input.json is the output of c2, or a bare SealVerifyInfo as c2 wrote it before it recorded\n" +
+		"the seed epoch. A bare SealVerifyInfo has no seed epoch, so it needs --height.",
+	Flags: append([]cli.Flag{
 		&cli.Int64Flag{
 			Name:  "height",
-			Usage: "specify a height",
+			Usage: "specify a height, required for a bare SealVerifyInfo, defaults to the seed epoch recorded by c2",
 		},
+	}, randomnessFlags...),
+	Subcommands: []*cli.Command{
+		verifyBatchCmd,
 	},
 	Action: func(c *cli.Context) error {
 		if !c.Args().Present() && !c.IsSet("s") {
 			return xerrors.Errorf("Usage: ubi verify [input.json]")
 		}
 
-		height := c.Int64("height")
-		if height == 0 {
-			return fmt.Errorf("must be specify a height")
-		}
 		var inb []byte
 		if c.IsSet("s") {
 			inb = []byte(c.String("s"))
@@ -907,28 +1113,27 @@ var verifyCmd = &cli.Command{
 			}
 		}
 
-		var svi prooftypes.SealVerifyInfo
-		if err := json.Unmarshal(inb, &svi); err != nil {
+		var proof C2Proof
+		if err := json.Unmarshal(inb, &proof); err != nil {
 			return xerrors.Errorf("unmarshalling input file: %w", err)
 		}
+		svi := proof.SealVerifyInfo
 
-		maddr, err := address.NewFromString("t0" + svi.Miner.String())
-		if err != nil {
-			return err
+		height := c.Int64("height")
+		if height == 0 {
+			height = proof.SeedEpoch
 		}
-
-		randomness, err := utils.GetRandomness(maddr, crypto.DomainSeparationTag_InteractiveSealChallengeSeed, height)
-		if err != nil {
-			return err
+		if height == 0 {
+			return xerrors.Errorf("the proof records no seed epoch, specify its --height")
 		}
-		svi.InteractiveRandomness = randomness
 
-		ok, err := ffiwrapper.ProofVerifier.VerifySeal(svi)
+		source, err := randomnessSource(c)
 		if err != nil {
 			return err
 		}
-		if !ok {
-			return xerrors.Errorf("proof for sector %d was invalid", svi.SectorID.Number)
+		defer source.Close()
+		if status, reason := checkSeal(c.Context, source, svi, height); status != VerifyValid {
+			return xerrors.Errorf("proof for sector %d was %s: %s", svi.SectorID.Number, status, reason)
 		}
 
 		fmt.Printf("seal: proof for sector %d was valid. \n", svi.SectorID.Number)
@@ -936,326 +1141,30 @@ var verifyCmd = &cli.Command{
 	},
 }
 
-func checkTaskCountByMcs(mAddr address.Address, sealer *ffiwrapper.Sealer, sdir string, c1in Commit1In, height, sectorType int64) {
-	response, err := http.Get(utils.GetConfig().HUB.TaskUrl)
-	if err != nil {
-		log.Errorf("Error making GET request: %v", err)
-		return
-	}
-	defer response.Body.Close()
-
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		log.Errorf("Error reading response body: %v", err)
-		return
-	}
-
-	var taskStats TaskStats
-	err = json.Unmarshal(body, &taskStats)
+func generaC1Out(ctx context.Context, source utils.RandomnessSource, mAddr address.Address, sealer *ffiwrapper.Sealer, sdir string, c1in Commit1In, height int64) (string, string, error) {
+	sampler := startSampler("")
+	c2in, err := commitPhase1(ctx, source, mAddr, sealer, c1in, height)
+	usage := sampler.Stop()
 	if err != nil {
-		log.Errorf("Error response convet to json: %v", err)
-		return
-	}
-
-	log.Infof("current task stats: %+v", taskStats.Data)
-	var rc512, rc32 ResourceCountList
-	for _, t := range taskStats.Data {
-		if sectorType == 512 && (t.ResourceId == CPU512 || t.ResourceId == GPU512) {
-			rc512 = append(rc512, t)
-		}
-		if sectorType == 32 && (t.ResourceId == CPU32G || t.ResourceId == GPU32G) {
-			rc32 = append(rc32, t)
-		}
-	}
-
-	var dirName, zkType string
-	var taskType int     //  1:Fil-C2-512M, 2:Aleo, 3:AI, 4:Fil-C2-32G
-	var resourceType int // 0: cpu 1: gpu
-	var needTask ResourceCount
-	if sectorType == 512 {
-		taskType = 1
-		sort.Sort(rc512)
-		if len(rc512) > 0 {
-			needTask = rc512[0]
-			if needTask.Count < 40000 {
-				dirName = "fil-c2/512M"
-				zkType = "fil-c2-512M"
-				if needTask.ResourceId == CPU512 {
-					resourceType = 0
-				} else {
-					resourceType = 1
-				}
-			} else {
-				return
-			}
-		} else {
-			return
-		}
-	} else {
-		taskType = 4
-		sort.Sort(rc32)
-		if len(rc32) > 0 {
-			needTask = rc32[0]
-			if needTask.Count < 40000 {
-				dirName = "fil-c2/32G"
-				zkType = "fil-c2-32G"
-				if needTask.ResourceId == CPU32G {
-					resourceType = 0
-				} else {
-					resourceType = 1
-				}
-			} else {
-				return
-			}
-		} else {
-			return
-		}
-	}
-
-	for i := 0; i < utils.GetConfig().HUB.BatchNum; i++ {
-		rootDir, taskDir, err := generaC1Out(mAddr, sealer, sdir, c1in, height+int64(i))
-		if err != nil {
-			log.Errorf("Error response convet to json: %v", err)
-			return
-		}
-
-		storageService := utils.NewStorageService()
-		storageService.CreateFolder(dirName, taskDir)
-
-		var inputParam, verifyParam string
-		err = filepath.Walk(rootDir, func(path string, f fs.FileInfo, err error) error {
-			if f.IsDir() {
-				return nil
-			}
-
-			fileUrl := uploadFile(storageService, dirName, taskDir, f.Name(), path)
-			fmt.Printf("file name: %s, url: %s \n", f.Name(), fileUrl)
-			if strings.Contains(f.Name(), "verify") {
-				verifyParam = fileUrl
-			} else {
-				inputParam = fileUrl
-			}
-			if err != nil {
-				return err
-			}
-			return nil
-		})
-
-		if strings.HasSuffix(inputParam, "ipfs/") || strings.HasSuffix(verifyParam, "ipfs/") {
-			continue
-		}
-
-		var task = Task{
-			Type:         taskType,
-			InputParam:   inputParam,
-			VerifyParam:  verifyParam,
-			ResourceID:   needTask.ResourceId,
-			ResourceType: resourceType,
-			Source:       0,
-		}
-		for i := 0; i < 20; i++ {
-			task.Name = taskDir + strconv.Itoa(i)
-			DoSend(task)
-		}
-
-		fmt.Println("==============")
-
-		latestHeight++
-		if err != nil {
-			log.Errorf("upload file to mcs failed, task: %s, zkType: %s", taskDir, zkType)
-			continue
-		}
-		os.RemoveAll(rootDir)
-	}
-
-}
-
-func checkTaskCountByTiTan(mAddr address.Address, sealer *ffiwrapper.Sealer, sdir string, c1in Commit1In, height, sectorType int64) {
-	response, err := http.Get(utils.GetConfig().HUB.TaskUrl + "&source=1")
-	if err != nil {
-		log.Errorf("Error making GET request: %v", err)
-		return
-	}
-	defer response.Body.Close()
-
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		log.Errorf("Error reading response body: %v", err)
-		return
+		return "", "", err
 	}
+	log.Infof("commit phase 1 resources, height: %d: %s", height, usage)
 
-	var taskStats TaskStats
-	err = json.Unmarshal(body, &taskStats)
+	sampler = startSampler(c1OutDir(sdir, c2in))
+	out, err := writeC1Out(ctx, sdir, c2in)
+	usage = sampler.Stop()
 	if err != nil {
-		log.Errorf("Error response convet to json: %v", err)
-		return
-	}
-
-	log.Infof("current task stats: %+v", taskStats.Data)
-	var rc512, rc32 ResourceCountList
-	for _, t := range taskStats.Data {
-		if sectorType == 512 && (t.ResourceId == CPU512 || t.ResourceId == GPU512) {
-			rc512 = append(rc512, t)
-		}
-		if sectorType == 32 && (t.ResourceId == CPU32G || t.ResourceId == GPU32G) {
-			rc32 = append(rc32, t)
-		}
-	}
-
-	var dirName, zkType string
-	var taskType int     //  1:Fil-C2-512M, 2:Aleo, 3:AI, 4:Fil-C2-32G
-	var resourceType int // 0: cpu 1: gpu
-	var needTask ResourceCount
-	if sectorType == 512 {
-		taskType = 1
-		sort.Sort(rc512)
-		if len(rc512) > 0 {
-			needTask = rc512[0]
-			if needTask.Count < 10000 {
-				dirName = "fil-c2/512M"
-				zkType = "fil-c2-512M"
-				if needTask.ResourceId == CPU512 {
-					resourceType = 0
-				} else {
-					resourceType = 1
-				}
-			} else {
-				return
-			}
-		} else {
-			return
-		}
-	} else {
-		taskType = 4
-		sort.Sort(rc32)
-		if len(rc32) > 0 {
-			needTask = rc32[0]
-			if needTask.Count < 10000 {
-				dirName = "fil-c2/32G"
-				zkType = "fil-c2-32G"
-				if needTask.ResourceId == CPU32G {
-					resourceType = 0
-				} else {
-					resourceType = 1
-				}
-			} else {
-				return
-			}
-		} else {
-			return
-		}
-	}
-
-	for i := 0; i < utils.GetConfig().HUB.BatchNum; i++ {
-		rootDir, taskDir, err := generaC1Out(mAddr, sealer, sdir, c1in, height+int64(i))
-		if err != nil {
-			log.Errorf("Error response convet to json: %v", err)
-			return
-		}
-
-		storageService, err := utils.NewTiTanClient(utils.GetConfig().HUB.TITAN_KEY)
-		if err != nil {
-			log.Errorf("Error create titan client: %v", err)
-			return
-		}
-
-		rootFolderId := utils.GetConfig().HUB.TITAN_FOLDER_512
-		if dirName == "fil-c2/32G" {
-			rootFolderId = utils.GetConfig().HUB.TITAN_FOLDER_32
-		}
-
-		var inputParam, verifyParam string
-		err = filepath.Walk(rootDir, func(path string, f fs.FileInfo, err error) error {
-			if f.IsDir() {
-				return nil
-			}
-
-			fileUrl := uploadFileToTiTan(storageService, rootFolderId, path)
-			fmt.Printf("file name: %s, url: %s \n", f.Name(), fileUrl)
-			if strings.Contains(f.Name(), "verify") {
-				verifyParam = fileUrl
-			} else {
-				inputParam = fileUrl
-			}
-			if err != nil {
-				return err
-			}
-			return nil
-		})
-
-		if strings.HasSuffix(inputParam, "ipfs/") || strings.HasSuffix(verifyParam, "ipfs/") {
-			continue
-		}
-
-		var task = Task{
-			Type:         taskType,
-			InputParam:   inputParam,
-			VerifyParam:  verifyParam,
-			ResourceID:   needTask.ResourceId,
-			ResourceType: resourceType,
-			Source:       1,
-		}
-		for i := 0; i < 20; i++ {
-			task.Name = taskDir + strconv.Itoa(i)
-			DoSend(task)
-		}
-
-		fmt.Println("==============")
-
-		latestHeight++
-		if err != nil {
-			log.Errorf("upload file to mcs failed, task: %s, zkType: %s", taskDir, zkType)
-			continue
-		}
-		os.RemoveAll(rootDir)
-	}
-
-}
-
-func uploadFile(storageService *utils.StorageService, dirName, taskDir, name, path string) string {
-	var result string
-
-	for i := 0; i < 3; i++ {
-		mcsOssFile, err := storageService.UploadFileToBucket(filepath.Join(dirName, taskDir, name), path, true)
-		if err != nil {
-			log.Errorf("Failed upload file to bucket, error: %v", err)
-			continue
-		}
-		gatewayUrl, err := storageService.GetGatewayUrl()
-		if err != nil {
-			log.Errorf("Failed get mcs ipfs gatewayUrl, error: %v", err)
-			continue
-		}
-
-		if mcsOssFile == nil || mcsOssFile.PayloadCid == "" {
-			continue
-		}
-
-		result = *gatewayUrl + "/ipfs/" + mcsOssFile.PayloadCid
-		break
-	}
-	return result
-}
-
-func uploadFileToTiTan(storageService *utils.TiTanClient, folderId int, path string) string {
-	var result string
-
-	for i := 0; i < 3; i++ {
-		url, err := storageService.UploadFile(path, folderId)
-		if err != nil {
-			log.Errorf("Failed upload file to ti-tan, error: %v", err)
-			continue
-		}
-		result = url
-		break
+		return "", "", err
 	}
-	return result
+	log.Infof("writing c1 out resources, height: %d: %s", height, usage)
+	return out.RootDir, out.TaskDir, nil
 }
 
-func generaC1Out(mAddr address.Address, sealer *ffiwrapper.Sealer, sdir string, c1in Commit1In, height int64) (string, string, error) {
-	randomness, err := utils.GetRandomness(mAddr, crypto.DomainSeparationTag_InteractiveSealChallengeSeed, height)
+// commitPhase1 runs SealCommit1 for c1in with the seed source gives for height.
+func commitPhase1(ctx context.Context, source utils.RandomnessSource, mAddr address.Address, sealer *ffiwrapper.Sealer, c1in Commit1In, height int64) (*Commit2In, error) {
+	randomness, err := source.GetRandomness(ctx, mAddr, crypto.DomainSeparationTag_InteractiveSealChallengeSeed, height)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
 	seed := lapi.SealSeed{
@@ -1263,9 +1172,9 @@ func generaC1Out(mAddr address.Address, sealer *ffiwrapper.Sealer, sdir string,
 		Value: randomness,
 	}
 
-	c1o, err := sealer.SealCommit1(context.TODO(), c1in.Sid, c1in.Ticket, seed.Value, c1in.Piece, c1in.Cids)
+	c1o, err := sealer.SealCommit1(ctx, c1in.Sid, c1in.Ticket, seed.Value, c1in.Piece, c1in.Cids)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
 	var c2in = new(Commit2In)
@@ -1275,45 +1184,83 @@ func generaC1Out(mAddr address.Address, sealer *ffiwrapper.Sealer, sdir string,
 	c2in.Sid = c1in.Sid
 	c2in.Ticket = c1in.Ticket
 	c2in.Seed = seed
-	c2inBytes, err := json.Marshal(c2in)
+	c2in.Phase1Out = c1o
+
+	log.Infof("seal: commit phase1 finished, sector_id: %d, num: %d\n", c1in.Sid.ID.Number, height)
+	return c2in, nil
+}
+
+type c1Out struct {
+	RootDir        string // task directory next to the storage directory
+	TaskDir        string // name of RootDir
+	RawSize        int64  // size of the Commit1 output before compression
+	CompressedSize int64
+}
+
+// c1OutDir returns the directory writeC1Out puts the output of c2in in.
+func c1OutDir(sdir string, c2in *Commit2In) string {
+	taskDir := fmt.Sprintf("%d-%d-%d-%d", c2in.Sid.ID.Miner, c2in.Sid.ID.Number, c2in.Sid.ProofType, c2in.Seed.Epoch)
+	return filepath.Join(filepath.Dir(sdir), taskDir)
+}
+
+// writeC1Out writes the verify json and the compressed Commit1 output of c2in into a task
+// directory next to sdir. The directory is removed again when writing fails or ctx is done, so
+// no half written task is left behind.
+func writeC1Out(ctx context.Context, sdir string, c2in *Commit2In) (_ *c1Out, err error) {
+	verifyIn := *c2in
+	verifyIn.Phase1Out = nil
+	c2inBytes, err := json.Marshal(verifyIn)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	taskDir := fmt.Sprintf("%d-%d-%d-%d", c2in.Sid.ID.Miner, c2in.Sid.ID.Number, c2in.Sid.ProofType, c2in.Seed.Epoch)
-	rootDir := filepath.Join(filepath.Dir(sdir), taskDir)
+	rootDir := c1OutDir(sdir, c2in)
+	taskDir := filepath.Base(rootDir)
 
 	err = os.MkdirAll(rootDir, 0775) //nolint:gosec
 	if err != nil {
-		return "", "", xerrors.Errorf("creating task dir: %w", err)
+		return nil, xerrors.Errorf("creating task dir: %w", err)
 	}
 	log.Infof("create dir: %s", rootDir)
+	defer func() {
+		if err != nil {
+			os.RemoveAll(rootDir)
+		}
+	}()
 
 	c2JsonFile := filepath.Join(rootDir, fmt.Sprintf("c1out-%d-%d-%d-verify.json", c2in.Sid.ID.Miner, c2in.Sid.ID.Number, c2in.Seed.Epoch))
 	if err = os.WriteFile(c2JsonFile, c2inBytes, 0666); err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	c2in.Phase1Out = c1o
 	c2inBytesWithC1, err := json.Marshal(c2in)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
-	c1JsonFile := filepath.Join(rootDir, fmt.Sprintf("c1out-%d-%d-%d.zst", c1in.Sid.ID.Miner, c1in.Sid.ID.Number, seed.Epoch))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c1JsonFile := filepath.Join(rootDir, fmt.Sprintf("c1out-%d-%d-%d.zst", c2in.Sid.ID.Miner, c2in.Sid.ID.Number, c2in.Seed.Epoch))
 	if err = utils.CompressDataToFile(c1JsonFile, c2inBytesWithC1); err != nil {
-		return "", "", err
+		return nil, err
 	}
-
-	log.Infof("seal: commit phase1 finished, sector_id: %d, num: %d\n", c1in.Sid.ID.Number, height)
-	return rootDir, taskDir, nil
+	fi, err := os.Stat(c1JsonFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &c1Out{
+		RootDir:        rootDir,
+		TaskDir:        taskDir,
+		RawSize:        int64(len(c2inBytesWithC1)),
+		CompressedSize: fi.Size(),
+	}, nil
 }
 
 func bps(sectorSize abi.SectorSize, sectorNum int, d time.Duration) string {
-	bdata := new(big.Int).SetUint64(uint64(sectorSize))
-	bdata = bdata.Mul(bdata, big.NewInt(int64(sectorNum)))
-	bdata = bdata.Mul(bdata, big.NewInt(time.Second.Nanoseconds()))
-	bps := bdata.Div(bdata, big.NewInt(d.Nanoseconds()))
-	return types.SizeStr(types.BigInt{Int: bps}) + "/s"
+	return sizeStr(throughput(sectorSize, sectorNum, d)) + "/s"
 }
 
 func spt(ssize abi.SectorSize, synth bool) abi.RegisteredSealProof {
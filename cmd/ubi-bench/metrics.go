@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	commit1Duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ubi_commit1_duration_seconds",
+		Help:    "Time spent computing Commit1 outputs.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"sector_type"})
+
+	compressionRatio = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ubi_compression_ratio",
+		Help:    "Uncompressed size of a Commit1 output divided by its compressed size.",
+		Buckets: []float64{1, 1.5, 2, 3, 4, 6, 8, 12, 16},
+	}, []string{"sector_type"})
+
+	uploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ubi_upload_duration_seconds",
+		Help:    "Latency of successful artifact uploads, per storage backend.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 12),
+	}, []string{"backend"})
+
+	uploadFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ubi_upload_failures_total",
+		Help: "Failed artifact upload attempts, per storage backend.",
+	}, []string{"backend"})
+
+	hubSubmissions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ubi_hub_submissions_total",
+		Help: "Tasks submitted to the hub, by outcome.",
+	}, []string{"status"})
+
+	stageFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ubi_pipeline_failures_total",
+		Help: "Tasks that failed a pipeline stage and wait to be resumed.",
+	}, []string{"stage"})
+
+	failedTasks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ubi_failed_tasks_total",
+		Help: "Tasks given up after failing PIPELINE.MAX_ATTEMPTS times.",
+	})
+
+	nextHeight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ubi_next_height",
+		Help: "First height of each sector type that has not been generated yet.",
+	}, []string{"sector_type"})
+
+	chainHead = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ubi_chain_head",
+		Help: "Height of the followed chain, as of the last check.",
+	})
+
+	phaseCPU = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ubi_phase_cpu_seconds_total",
+		Help: "Process cpu time while a pipeline stage ran, stages running at the same time share it.",
+	}, []string{"phase", "sector_type"})
+
+	phaseIO = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ubi_phase_io_bytes_total",
+		Help: "Bytes the process read or wrote while a pipeline stage ran.",
+	}, []string{"phase", "sector_type", "direction"})
+
+	phasePeakRSS = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ubi_phase_peak_rss_bytes",
+		Help: "Peak resident memory of the process during the last run of a pipeline stage.",
+	}, []string{"phase", "sector_type"})
+
+	phaseTempDisk = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ubi_phase_temp_disk_bytes",
+		Help: "Peak disk space the last run of a pipeline stage added to its working directory.",
+	}, []string{"phase", "sector_type"})
+
+	hubQueuedTasks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ubi_hub_queued_tasks",
+		Help: "Queued hub tasks per source and resource id, as of the last task stats request.",
+	}, []string{"source", "resource_id"})
+
+	hubStatsUpdated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ubi_hub_stats_updated_timestamp_seconds",
+		Help: "Unix time of the last successful task stats request per source.",
+	}, []string{"source"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		commit1Duration,
+		compressionRatio,
+		uploadDuration,
+		uploadFailures,
+		hubSubmissions,
+		stageFailures,
+		failedTasks,
+		nextHeight,
+		chainHead,
+		phaseCPU,
+		phaseIO,
+		phasePeakRSS,
+		phaseTempDisk,
+		hubQueuedTasks,
+		hubStatsUpdated,
+	)
+}
+
+func observeTaskStats(source int, stats *TaskStats) {
+	for _, rc := range stats.Data {
+		hubQueuedTasks.WithLabelValues(strconv.Itoa(source), strconv.Itoa(rc.ResourceId)).Set(float64(rc.Count))
+	}
+	hubStatsUpdated.WithLabelValues(strconv.Itoa(source)).SetToCurrentTime()
+}
+
+func observeResources(phase string, sectorType int64, u ResourceUsage) {
+	st := strconv.FormatInt(sectorType, 10)
+	phaseCPU.WithLabelValues(phase, st).Add(u.CPUTime.Seconds())
+	phaseIO.WithLabelValues(phase, st, "read").Add(float64(u.ReadBytes))
+	phaseIO.WithLabelValues(phase, st, "write").Add(float64(u.WriteBytes))
+	phasePeakRSS.WithLabelValues(phase, st).Set(float64(u.PeakRSS))
+	phaseTempDisk.WithLabelValues(phase, st).Set(float64(u.PeakTempDisk))
+}
+
+// submitStatus maps the result of HubClient.Submit to the status label of hubSubmissions.
+func submitStatus(err error) string {
+	switch {
+	case err == nil:
+		return "submitted"
+	case errors.Is(err, ErrTaskDuplicate):
+		return "duplicate"
+	case errors.Is(err, ErrTaskRejected):
+		return "rejected"
+	case errors.Is(err, ErrHubThrottled):
+		return "throttled"
+	case errors.Is(err, ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, ErrHubServer):
+		return "server_error"
+	default:
+		return "error"
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/swanchain/ubi-benchmark/utils"
+)
+
+const (
+	stageCommit1  = "commit1"
+	stageCompress = "compress"
+	stageUpload   = "upload"
+	stageSubmit   = "submit"
+
+	defaultMaxAttempts  = 8
+	defaultRetryBackoff = time.Minute
+	maxRetryBackoff     = time.Hour
+)
+
+type pipelineJob struct {
+	supplier taskSupplier
+	rec      TaskRecord
+	c2in     *Commit2In // Commit1 output waiting to be compressed
+}
+
+// pipeline runs the daemon's tasks through bounded worker pools, one per stage, connected by
+// channels. At most depth tasks are in flight; every channel can hold all of them, so handing
+// a task to the next stage never blocks a worker.
+type pipeline struct {
+	d     *daemon
+	depth int
+
+	maxAttempts  int
+	retryBackoff time.Duration
+
+	stages []*pipelineStage
+
+	wg sync.WaitGroup
+
+	lk       sync.Mutex
+	inflight map[string]string // record key -> stage
+	draining bool
+}
+
+type pipelineStage struct {
+	name    string
+	workers int
+	queue   chan *pipelineJob
+	run     func(context.Context, *pipelineJob) error
+}
+
+func newPipeline(d *daemon, cfg utils.PIPELINE) *pipeline {
+	p := &pipeline{
+		d:        d,
+		depth:    cfg.QueueDepth,
+		inflight: make(map[string]string),
+	}
+	if p.depth <= 0 {
+		p.depth = 2 * utils.GetConfig().HUB.BatchNum
+	}
+	if p.depth <= 0 {
+		p.depth = 1
+	}
+	p.maxAttempts = cfg.MaxAttempts
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = defaultMaxAttempts
+	}
+	p.retryBackoff = time.Duration(cfg.RetryBackoff) * time.Second
+	if p.retryBackoff <= 0 {
+		p.retryBackoff = defaultRetryBackoff
+	}
+
+	for _, stage := range []struct {
+		name    string
+		workers int
+		run     func(context.Context, *pipelineJob) error
+	}{
+		{stageCommit1, cfg.Commit1Workers, d.commit1},
+		{stageCompress, cfg.CompressWorkers, d.compress},
+		{stageUpload, cfg.UploadWorkers, d.upload},
+		{stageSubmit, cfg.SubmitWorkers, d.submit},
+	} {
+		workers := stage.workers
+		if workers <= 0 {
+			workers = 1
+		}
+		p.stages = append(p.stages, &pipelineStage{
+			name:    stage.name,
+			workers: workers,
+			queue:   make(chan *pipelineJob, p.depth),
+			run:     stage.run,
+		})
+	}
+	return p
+}
+
+// start runs the workers until ctx is done. Cancelling ctx aborts the tasks being worked on, use
+// drain first to let them finish.
+func (p *pipeline) start(ctx context.Context) {
+	for i, stage := range p.stages {
+		var next *pipelineStage
+		if i+1 < len(p.stages) {
+			next = p.stages[i+1]
+		}
+		for w := 0; w < stage.workers; w++ {
+			p.wg.Add(1)
+			go p.work(ctx, stage, next)
+		}
+	}
+}
+
+func (p *pipeline) work(ctx context.Context, stage, next *pipelineStage) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-stage.queue:
+			if stage == p.stages[0] && p.isDraining() {
+				// not started yet, the ledger keeps it pending for the next run
+				p.done(job)
+				continue
+			}
+			if err := stage.run(ctx, job); err != nil {
+				if ctx.Err() != nil {
+					log.Warnf("%s of task %s interrupted, it is resumed on the next run", stage.name, job.rec.Key())
+					p.done(job)
+					continue
+				}
+				log.Errorf("Failed %s task %s, store: %s, error: %v", stage.name, job.rec.Key(), job.supplier.store.Name(), err)
+				stageFailures.WithLabelValues(stage.name).Inc()
+				p.fail(job, err)
+				p.done(job)
+				continue
+			}
+			if next == nil {
+				p.done(job)
+				continue
+			}
+			p.move(job, next.name)
+			next.queue <- job
+		}
+	}
+}
+
+// fail records a failed attempt of job. The task is resumed after a backoff that doubles with
+// every attempt and is given up after maxAttempts attempts, so tasks that keep failing do not
+// take the pipeline from new ones.
+func (p *pipeline) fail(job *pipelineJob, err error) {
+	rec, lerr := p.d.ledger.Fail(job.rec.Key(), err.Error(), p.maxAttempts, p.backoff)
+	if lerr != nil {
+		log.Errorf("Failed record failed attempt of task %s, error: %v", job.rec.Key(), lerr)
+		return
+	}
+	switch {
+	case rec.Status == TaskFailed:
+		failedTasks.Inc()
+		os.RemoveAll(rec.RootDir)
+		log.Errorf("task %s failed %d times, giving up on it", rec.Key(), rec.Attempts)
+	case !rec.Status.finished():
+		log.Warnf("task %s failed %d of %d attempts, retrying it after %s", rec.Key(), rec.Attempts, p.maxAttempts,
+			rec.NextAttempt.Format(time.RFC3339))
+	}
+}
+
+func (p *pipeline) backoff(attempts int) time.Duration {
+	d := p.retryBackoff
+	for i := 1; i < attempts && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryBackoff)
+}
+
+// enqueue hands rec to the stage matching its ledger status. It returns false when the
+// pipeline is full or draining, or the task is already in flight.
+func (p *pipeline) enqueue(supplier taskSupplier, rec TaskRecord) bool {
+	stage := p.stages[0]
+	switch rec.Status {
+	case TaskGenerated:
+		if artifactsExist(rec.Artifacts) {
+			stage = p.stages[2]
+		} else {
+			rec.Status = TaskPending
+		}
+	case TaskUploaded:
+		stage = p.stages[3]
+	}
+
+	p.lk.Lock()
+	if _, ok := p.inflight[rec.Key()]; ok || p.draining || len(p.inflight) >= p.depth {
+		p.lk.Unlock()
+		return false
+	}
+	p.inflight[rec.Key()] = stage.name
+	p.lk.Unlock()
+
+	stage.queue <- &pipelineJob{supplier: supplier, rec: rec}
+	return true
+}
+
+// room returns how many more tasks the pipeline accepts.
+func (p *pipeline) room() int {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.depth - len(p.inflight)
+}
+
+// drain stops the pipeline from taking new tasks and waits up to timeout for the tasks past
+// Commit1 to finish. Queued tasks that have not started are dropped, they stay pending in the
+// ledger. It returns false when tasks were still in flight at the timeout.
+func (p *pipeline) drain(timeout time.Duration) bool {
+	p.lk.Lock()
+	p.draining = true
+	p.lk.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		p.lk.Lock()
+		n := len(p.inflight)
+		p.lk.Unlock()
+		if n == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// wait waits up to timeout for the workers to return after their context is done.
+func (p *pipeline) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (p *pipeline) isDraining() bool {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return p.draining
+}
+
+func (p *pipeline) inFlight(rec TaskRecord) bool {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	_, ok := p.inflight[rec.Key()]
+	return ok
+}
+
+// snapshot returns the stage of every task in flight, by ledger key.
+func (p *pipeline) snapshot() map[string]string {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	out := make(map[string]string, len(p.inflight))
+	for key, stage := range p.inflight {
+		out[key] = stage
+	}
+	return out
+}
+
+func (p *pipeline) move(job *pipelineJob, stage string) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.inflight[job.rec.Key()] = stage
+}
+
+func (p *pipeline) done(job *pipelineJob) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	delete(p.inflight, job.rec.Key())
+}
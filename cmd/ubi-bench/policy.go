@@ -0,0 +1,213 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/swanchain/ubi-benchmark/utils"
+)
+
+type policyKey struct {
+	source     int
+	resourceId int
+}
+
+// replenishPolicy decides how many tasks to generate for a resource from its hub queue depth.
+// Refilling starts once the queue drops below the low watermark and continues on every tick
+// until it reaches the high watermark.
+type replenishPolicy struct {
+	cfg utils.POLICY
+
+	lk        sync.Mutex
+	refilling map[policyKey]bool
+}
+
+func newReplenishPolicy(cfg utils.POLICY) *replenishPolicy {
+	return &replenishPolicy{
+		cfg:       cfg,
+		refilling: make(map[policyKey]bool),
+	}
+}
+
+// resolve returns the settings for resourceId of source. Values set in [POLICY] override the
+// store's defaults, rules matching only the source or only the resource override those, and a
+// rule matching both wins over everything else.
+func (p *replenishPolicy) resolve(source, resourceId, defaultLow int) utils.Replenish {
+	p.lk.Lock()
+	cfg := p.cfg
+	p.lk.Unlock()
+
+	r := utils.Replenish{
+		LowWatermark:    defaultLow,
+		Copies:          taskCopies,
+		MaxTasksPerTick: utils.GetConfig().HUB.BatchNum,
+	}
+	mergeReplenish(&r, cfg.Replenish)
+
+	for _, specific := range []func(rule utils.PolicyRule) bool{
+		func(rule utils.PolicyRule) bool { return rule.Source != nil && rule.ResourceId == 0 },
+		func(rule utils.PolicyRule) bool { return rule.Source == nil && rule.ResourceId != 0 },
+		func(rule utils.PolicyRule) bool { return rule.Source != nil && rule.ResourceId != 0 },
+	} {
+		for _, rule := range cfg.Rules {
+			if !specific(rule) {
+				continue
+			}
+			if rule.Source != nil && *rule.Source != source {
+				continue
+			}
+			if rule.ResourceId != 0 && rule.ResourceId != resourceId {
+				continue
+			}
+			mergeReplenish(&r, rule.Replenish)
+		}
+	}
+
+	if r.HighWatermark < r.LowWatermark {
+		r.HighWatermark = r.LowWatermark
+	}
+	if r.Copies <= 0 {
+		r.Copies = taskCopies
+	}
+	return r
+}
+
+// tickBudget returns how many tasks one tick generates across all resources: MAX_TASKS_PER_TICK
+// of [POLICY], or HUB.BATCH_NUM. A rule's MAX_TASKS_PER_TICK only caps its own resources.
+func (p *replenishPolicy) tickBudget() int {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if p.cfg.MaxTasksPerTick > 0 {
+		return p.cfg.MaxTasksPerTick
+	}
+	return utils.GetConfig().HUB.BatchNum
+}
+
+// reload replaces the policy's settings. Resources that are refilling keep refilling until
+// they reach the new high watermark.
+func (p *replenishPolicy) reload(cfg utils.POLICY) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.cfg = cfg
+}
+
+type replenishPlan struct {
+	ResourceId int
+	Tasks      int // artifacts to generate
+	Copies     int // hub tasks submitted per artifact
+	Shortfall  int // queued tasks missing to reach the target depth or high watermark
+}
+
+// plan returns how many tasks to generate for rc on this tick.
+func (p *replenishPolicy) plan(source int, rc ResourceCount, defaultLow int) replenishPlan {
+	r := p.resolve(source, rc.ResourceId, defaultLow)
+	key := policyKey{source: source, resourceId: rc.ResourceId}
+	plan := replenishPlan{ResourceId: rc.ResourceId, Copies: r.Copies}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if rc.Count >= r.HighWatermark {
+		delete(p.refilling, key)
+		return plan
+	}
+	if rc.Count < r.LowWatermark {
+		p.refilling[key] = true
+	}
+	if !p.refilling[key] {
+		return plan
+	}
+
+	target := r.HighWatermark
+	if r.TargetDepth > 0 {
+		target = r.TargetDepth
+	}
+	plan.Shortfall = target - rc.Count
+	if plan.Shortfall < 1 {
+		plan.Shortfall = 1
+	}
+
+	plan.Tasks = r.MaxTasksPerTick
+	if r.TargetDepth > 0 {
+		need := (r.TargetDepth - rc.Count + r.Copies - 1) / r.Copies
+		if need < plan.Tasks {
+			plan.Tasks = need
+		}
+	}
+	if plan.Tasks < 0 {
+		plan.Tasks = 0
+	}
+	return plan
+}
+
+// distributeTasks caps the plans to budget tasks in total, sharing the budget in proportion to
+// each resource's shortfall. Plans keep their order, earlier plans win ties.
+func distributeTasks(plans []replenishPlan, budget int) []replenishPlan {
+	var demand int
+	for _, plan := range plans {
+		demand += plan.Tasks
+	}
+	if demand <= budget {
+		return plans
+	}
+
+	out := make([]replenishPlan, len(plans))
+	copy(out, plans)
+	for i := range out {
+		out[i].Tasks = 0
+	}
+
+	for budget > 0 {
+		var total int
+		for i, plan := range plans {
+			if out[i].Tasks < plan.Tasks {
+				total += plan.Shortfall
+			}
+		}
+		if total == 0 {
+			break
+		}
+
+		var given int
+		for i, plan := range plans {
+			if out[i].Tasks >= plan.Tasks {
+				continue
+			}
+			share := budget * plan.Shortfall / total
+			if left := plan.Tasks - out[i].Tasks; share > left {
+				share = left
+			}
+			out[i].Tasks += share
+			given += share
+		}
+		if given == 0 {
+			// every share rounded down, hand one task to the largest unserved shortfall
+			best := -1
+			for i, plan := range plans {
+				if out[i].Tasks < plan.Tasks && (best < 0 || plan.Shortfall > plans[best].Shortfall) {
+					best = i
+				}
+			}
+			out[best].Tasks++
+			given = 1
+		}
+		budget -= given
+	}
+	return out
+}
+
+func mergeReplenish(dst *utils.Replenish, src utils.Replenish) {
+	if src.LowWatermark > 0 {
+		dst.LowWatermark = src.LowWatermark
+	}
+	if src.HighWatermark > 0 {
+		dst.HighWatermark = src.HighWatermark
+	}
+	if src.TargetDepth > 0 {
+		dst.TargetDepth = src.TargetDepth
+	}
+	if src.Copies > 0 {
+		dst.Copies = src.Copies
+	}
+	if src.MaxTasksPerTick > 0 {
+		dst.MaxTasksPerTick = src.MaxTasksPerTick
+	}
+}
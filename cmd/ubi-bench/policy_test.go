@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestDistributeTasks(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		plans  []replenishPlan
+		budget int
+		want   []int
+	}{
+		{
+			name:   "demand within budget",
+			plans:  []replenishPlan{{Tasks: 2, Shortfall: 10}, {Tasks: 3, Shortfall: 30}},
+			budget: 10,
+			want:   []int{2, 3},
+		},
+		{
+			name:   "proportional to shortfall",
+			plans:  []replenishPlan{{Tasks: 10, Shortfall: 100}, {Tasks: 10, Shortfall: 300}},
+			budget: 8,
+			want:   []int{2, 6},
+		},
+		{
+			name:   "share capped by the plan",
+			plans:  []replenishPlan{{Tasks: 1, Shortfall: 900}, {Tasks: 10, Shortfall: 100}},
+			budget: 6,
+			want:   []int{1, 5},
+		},
+		{
+			name:   "rounded down shares go to the largest shortfall",
+			plans:  []replenishPlan{{Tasks: 5, Shortfall: 10}, {Tasks: 5, Shortfall: 20}, {Tasks: 5, Shortfall: 15}},
+			budget: 1,
+			want:   []int{0, 1, 0},
+		},
+		{
+			name:   "ties go to the earlier plan",
+			plans:  []replenishPlan{{Tasks: 5, Shortfall: 10}, {Tasks: 5, Shortfall: 10}},
+			budget: 3,
+			want:   []int{2, 1},
+		},
+		{
+			name:   "no budget",
+			plans:  []replenishPlan{{Tasks: 5, Shortfall: 10}},
+			budget: 0,
+			want:   []int{0},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := distributeTasks(tc.plans, tc.budget)
+			var total int
+			for i, plan := range got {
+				if plan.Tasks != tc.want[i] {
+					t.Fatalf("plan %d got %d tasks, want %d (all: %+v)", i, plan.Tasks, tc.want[i], got)
+				}
+				if plan.Tasks > tc.plans[i].Tasks {
+					t.Fatalf("plan %d got more tasks than it asked for", i)
+				}
+				total += plan.Tasks
+			}
+			if total > tc.budget {
+				t.Fatalf("handed out %d tasks, budget %d", total, tc.budget)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+)
+
+const gib = 1 << 30
+
+// resourceClass is what one Commit2 task of a hub resource id needs. The numbers are planning
+// estimates for the v28 proofs, measure with `ubi-bench sealing --commit` before relying on them.
+type resourceClass struct {
+	ResourceId int
+	Name       string
+	GPU        bool
+	Cores      int    // cores per task
+	Memory     uint64 // RAM per task
+	GPUMemory  uint64 // memory of the GPU per task
+	Params     uint64 // proof parameters on disk, shared by all tasks
+}
+
+var resourceClasses = []resourceClass{
+	{ResourceId: CPU512, Name: "CPU512", Cores: 4, Memory: 4 * gib, Params: 1 * gib},
+	{ResourceId: CPU32G, Name: "CPU32G", Cores: 32, Memory: 192 * gib, Params: 50 * gib},
+	{ResourceId: GPU512, Name: "GPU512", GPU: true, Cores: 2, Memory: 4 * gib, GPUMemory: 4 * gib, Params: 1 * gib},
+	{ResourceId: GPU32G, Name: "GPU32G", GPU: true, Cores: 8, Memory: 160 * gib, GPUMemory: 10 * gib, Params: 50 * gib},
+}
+
+type ProbeGPU struct {
+	Model  string
+	Memory uint64 `json:",omitempty"` // bytes, only known with nvidia-smi
+}
+
+type ProbeReport struct {
+	Hardware     Hardware
+	CPUFlags     map[string]bool // sha_ni, avx2 and adx
+	NUMANodes    int
+	GPUs         []ProbeGPU
+	MemAvailable uint64
+	HugePages    uint64 // configured huge pages, bytes
+	StorageDir   string
+	StorageFree  uint64
+	ParamsDir    string
+	ParamsFree   uint64
+	ParamsSize   uint64 // proof parameters already downloaded
+	EnvVar       map[string]string
+	Classes      []ClassReport
+}
+
+type ClassReport struct {
+	Name        string
+	ResourceId  int
+	Parallelism int      // tasks the machine can run at once, 0 if it cannot serve the class
+	Limits      []string // what bounds the parallelism
+}
+
+var probeCmd = &cli.Command{
+	Name:  "probe",
+	Usage: "Inspect the hardware and report which resource classes it can serve",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "storage-dir",
+			Value: "~/.ubi-bench",
+			Usage: "directory the tasks will work in",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the report as json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		sdir, err := homedir.Expand(c.String("storage-dir"))
+		if err != nil {
+			return err
+		}
+		report := probeHardware(c.Context, sdir)
+
+		if c.Bool("json") {
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+			return nil
+		}
+		printProbeReport(report)
+		return nil
+	},
+}
+
+func probeHardware(ctx context.Context, sdir string) *ProbeReport {
+	r := &ProbeReport{
+		Hardware:     collectHardware(),
+		CPUFlags:     make(map[string]bool),
+		MemAvailable: procKB("/proc/meminfo", "MemAvailable"),
+		StorageDir:   sdir,
+		ParamsDir:    paramsDir(),
+		EnvVar:       make(map[string]string),
+	}
+
+	flags := strings.Fields(procField("/proc/cpuinfo", "flags"))
+	for _, want := range []string{"sha_ni", "avx2", "adx"} {
+		r.CPUFlags[want] = false
+		for _, flag := range flags {
+			if flag == want {
+				r.CPUFlags[want] = true
+			}
+		}
+	}
+
+	nodes, _ := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	r.NUMANodes = max(len(nodes), 1)
+
+	pages, _ := strconv.ParseUint(procField("/proc/meminfo", "HugePages_Total"), 10, 64)
+	r.HugePages = pages * procKB("/proc/meminfo", "Hugepagesize")
+
+	r.GPUs = probeGPUs(ctx)
+	if len(r.GPUs) == 0 {
+		for _, model := range r.Hardware.GPUs {
+			r.GPUs = append(r.GPUs, ProbeGPU{Model: model})
+		}
+	}
+
+	r.StorageFree = freeSpace(sdir)
+	r.ParamsFree = freeSpace(r.ParamsDir)
+	r.ParamsSize = dirSize(r.ParamsDir)
+
+	for _, key := range append(proofEnvVars, "FIL_PROOFS_PARAMETER_CACHE", "FIL_PROOFS_MAXIMIZE_CACHING", "CUDA_VISIBLE_DEVICES") {
+		if v, ok := os.LookupEnv(key); ok {
+			r.EnvVar[key] = v
+		}
+	}
+
+	for _, class := range resourceClasses {
+		r.Classes = append(r.Classes, r.sizeClass(class))
+	}
+	return r
+}
+
+// sizeClass estimates how many tasks of class the machine runs at once.
+func (r *ProbeReport) sizeClass(class resourceClass) ClassReport {
+	out := ClassReport{Name: class.Name, ResourceId: class.ResourceId}
+	type bound struct {
+		n     int
+		limit string
+	}
+	bounds := []bound{
+		{r.Hardware.CPUCores / class.Cores, fmt.Sprintf("%d cores, %d per task", r.Hardware.CPUCores, class.Cores)},
+		{int(r.Hardware.MemTotal * 9 / 10 / class.Memory), fmt.Sprintf("%s RAM, %s per task", sizeStr(new(big.Int).SetUint64(r.Hardware.MemTotal)), sizeStr(new(big.Int).SetUint64(class.Memory)))},
+	}
+	if class.GPU {
+		n := 0
+		for _, gpu := range r.GPUs {
+			switch {
+			case gpu.Memory == 0:
+				n++ // unknown memory, assume one task fits
+			default:
+				n += int(gpu.Memory / class.GPUMemory)
+			}
+		}
+		if r.EnvVar["BELLMAN_NO_GPU"] != "" {
+			n = 0
+		}
+		bounds = append(bounds, bound{n, fmt.Sprintf("%d gpus, %s gpu memory per task", len(r.GPUs), sizeStr(new(big.Int).SetUint64(class.GPUMemory)))})
+	}
+	if r.ParamsSize < class.Params && r.ParamsFree < class.Params-r.ParamsSize {
+		bounds = append(bounds, bound{0, fmt.Sprintf("%s free for %s of proof parameters in %s", sizeStr(new(big.Int).SetUint64(r.ParamsFree)), sizeStr(new(big.Int).SetUint64(class.Params)), r.ParamsDir)})
+	}
+
+	out.Parallelism = -1
+	for _, b := range bounds {
+		switch {
+		case out.Parallelism < 0 || b.n < out.Parallelism:
+			out.Parallelism = b.n
+			out.Limits = []string{b.limit}
+		case b.n == out.Parallelism:
+			out.Limits = append(out.Limits, b.limit)
+		}
+	}
+	return out
+}
+
+func printProbeReport(r *ProbeReport) {
+	fmt.Printf("host: %s (%s/%s)\n", r.Hardware.Hostname, r.Hardware.OS, r.Hardware.Arch)
+	fmt.Printf("cpu: %s, %d cores, %d numa nodes\n", r.Hardware.CPUModel, r.Hardware.CPUCores, r.NUMANodes)
+	var flags []string
+	for _, name := range []string{"sha_ni", "avx2", "adx"} {
+		mark := "no"
+		if r.CPUFlags[name] {
+			mark = "yes"
+		}
+		flags = append(flags, name+": "+mark)
+	}
+	fmt.Printf("cpu features: %s\n", strings.Join(flags, ", "))
+	fmt.Printf("memory: %s, %s available, %s huge pages\n", sizeStr(new(big.Int).SetUint64(r.Hardware.MemTotal)),
+		sizeStr(new(big.Int).SetUint64(r.MemAvailable)), sizeStr(new(big.Int).SetUint64(r.HugePages)))
+	if len(r.GPUs) == 0 {
+		fmt.Println("gpu: none found")
+	}
+	for i, gpu := range r.GPUs {
+		if gpu.Memory > 0 {
+			fmt.Printf("gpu %d: %s, %s\n", i, gpu.Model, sizeStr(new(big.Int).SetUint64(gpu.Memory)))
+		} else {
+			fmt.Printf("gpu %d: %s\n", i, gpu.Model)
+		}
+	}
+	fmt.Printf("storage: %s free in %s\n", sizeStr(new(big.Int).SetUint64(r.StorageFree)), r.StorageDir)
+	fmt.Printf("proof parameters: %s in %s, %s free\n", sizeStr(new(big.Int).SetUint64(r.ParamsSize)), r.ParamsDir, sizeStr(new(big.Int).SetUint64(r.ParamsFree)))
+	if len(r.EnvVar) > 0 {
+		fmt.Println("environment variable list:")
+		keys := make([]string, 0, len(r.EnvVar))
+		for key := range r.EnvVar {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%s=%s\n", key, r.EnvVar[key])
+		}
+	}
+	if !r.CPUFlags["avx2"] {
+		fmt.Println("warning: the cpu has no avx2, proofs will be slow")
+	}
+
+	fmt.Println("----\nresource classes (estimates):")
+	for _, class := range r.Classes {
+		if class.Parallelism == 0 {
+			fmt.Printf("%-7s not supported: %s\n", class.Name, strings.Join(class.Limits, "; "))
+			continue
+		}
+		fmt.Printf("%-7s %d in parallel, limited by %s\n", class.Name, class.Parallelism, strings.Join(class.Limits, "; "))
+	}
+}
+
+// probeGPUs asks nvidia-smi for the GPUs and their memory, nil when it is not installed.
+func probeGPUs(ctx context.Context) []ProbeGPU {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "nvidia-smi", "--query-gpu=name,memory.total", "--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return nil
+	}
+	var gpus []ProbeGPU
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		name, mem, ok := strings.Cut(scanner.Text(), ",")
+		if !ok {
+			continue
+		}
+		mib, _ := strconv.ParseUint(strings.TrimSpace(mem), 10, 64)
+		gpus = append(gpus, ProbeGPU{Model: strings.TrimSpace(name), Memory: mib << 20})
+	}
+	return gpus
+}
+
+// paramsDir is where the proofs library keeps its parameters.
+func paramsDir() string {
+	if dir := os.Getenv("FIL_PROOFS_PARAMETER_CACHE"); dir != "" {
+		return dir
+	}
+	return "/var/tmp/filecoin-proof-parameters"
+}
+
+// freeSpace returns the bytes available to unprivileged users on the file system of path, or
+// of its closest existing parent.
+func freeSpace(path string) uint64 {
+	for {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err == nil {
+			return st.Bavail * uint64(st.Bsize)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return 0
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/swanchain/ubi-benchmark/utils"
+	"github.com/urfave/cli/v2"
+)
+
+// randomnessFlags select the seed source of the commands that run without the config file.
+// They must match the [RANDOMNESS] section of the daemon that generated the tasks.
+var randomnessFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "randomness",
+		Usage:   "seed source: mock, lotus or drand",
+		EnvVars: []string{"UBI_RANDOMNESS_SOURCE"},
+		Value:   utils.RandomnessMock,
+	},
+	&cli.StringFlag{
+		Name:    "lotus-api",
+		Usage:   "FULLNODE_API_INFO of the node used by --randomness lotus",
+		EnvVars: []string{"UBI_RANDOMNESS_LOTUS_API", "FULLNODE_API_INFO"},
+	},
+	&cli.StringFlag{
+		Name:    "drand-network",
+		Usage:   "drand network used by --randomness drand: quicknet or mainnet",
+		EnvVars: []string{"UBI_RANDOMNESS_DRAND_NETWORK"},
+		Value:   "quicknet",
+	},
+	&cli.Int64Flag{
+		Name:    "genesis-time",
+		Usage:   "unix time of height 0 the drand source maps heights from, 0 for Filecoin mainnet",
+		EnvVars: []string{"UBI_RANDOMNESS_GENESIS_TIME"},
+	},
+	&cli.Int64Flag{
+		Name:    "block-delay",
+		Usage:   "seconds per height of the drand source, 0 for Filecoin mainnet",
+		EnvVars: []string{"UBI_RANDOMNESS_BLOCK_DELAY"},
+	},
+}
+
+func randomnessSource(c *cli.Context) (utils.RandomnessSource, error) {
+	return utils.NewRandomnessSource(c.Context, utils.RANDOMNESS{
+		Source:       c.String("randomness"),
+		LotusApi:     c.String("lotus-api"),
+		DrandNetwork: c.String("drand-network"),
+		GenesisTime:  c.Int64("genesis-time"),
+		BlockDelay:   c.Int64("block-delay"),
+	})
+}
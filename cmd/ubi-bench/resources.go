@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sampleInterval = time.Second
+	clockTicks     = 100 // USER_HZ, the unit of the cpu times in /proc/self/stat
+)
+
+// ResourceUsage is what the process consumed while a phase ran. The counters are process-wide:
+// a resourceSampler counts all of them for its phase, a usageMeter splits them between the
+// phases running at the same time.
+type ResourceUsage struct {
+	Duration     time.Duration
+	CPUTime      time.Duration
+	CPUPercent   float64 // average utilisation, 100 per busy core
+	PeakRSS      uint64  // bytes
+	PeakCgroup   uint64  `json:",omitempty"` // peak memory of the process' cgroup, bytes
+	ReadBytes    uint64  // read from storage
+	WriteBytes   uint64  // written to storage
+	PeakTempDisk uint64  // peak growth of the phase's working directory, bytes
+}
+
+func (u ResourceUsage) String() string {
+	s := fmt.Sprintf("cpu %s (%.0f%%), peak rss %s, read %s, written %s, temp disk %s",
+		u.CPUTime.Round(time.Millisecond), u.CPUPercent, sizeStr(new(big.Int).SetUint64(u.PeakRSS)),
+		sizeStr(new(big.Int).SetUint64(u.ReadBytes)), sizeStr(new(big.Int).SetUint64(u.WriteBytes)),
+		sizeStr(new(big.Int).SetUint64(u.PeakTempDisk)))
+	if u.PeakCgroup > 0 {
+		s += ", peak cgroup memory " + sizeStr(new(big.Int).SetUint64(u.PeakCgroup))
+	}
+	return s
+}
+
+// add merges o into u: times and bytes add up, peaks keep the larger value.
+func (u *ResourceUsage) add(o ResourceUsage) {
+	u.Duration += o.Duration
+	u.CPUTime += o.CPUTime
+	u.PeakRSS = max(u.PeakRSS, o.PeakRSS)
+	u.PeakCgroup = max(u.PeakCgroup, o.PeakCgroup)
+	u.ReadBytes += o.ReadBytes
+	u.WriteBytes += o.WriteBytes
+	u.PeakTempDisk = max(u.PeakTempDisk, o.PeakTempDisk)
+	u.CPUPercent = 0
+	if u.Duration > 0 {
+		u.CPUPercent = float64(u.CPUTime) / float64(u.Duration) * 100
+	}
+}
+
+// resourceSampler samples the process every sampleInterval until it is stopped.
+type resourceSampler struct {
+	dir   string
+	start time.Time
+
+	cpu0            time.Duration
+	read0, written0 uint64
+	disk0           uint64
+	stop            chan struct{}
+	done            chan struct{}
+
+	lk    sync.Mutex
+	usage ResourceUsage
+}
+
+// startSampler starts sampling, dir is the working directory whose growth is tracked, empty
+// to not track any.
+func startSampler(dir string) *resourceSampler {
+	s := &resourceSampler{
+		dir:   dir,
+		start: time.Now(),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	s.cpu0 = processCPUTime()
+	s.read0, s.written0 = processIO()
+	s.disk0 = dirSize(dir)
+	s.sample()
+
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.sample()
+			}
+		}
+	}()
+	return s
+}
+
+func (s *resourceSampler) sample() {
+	rss := processRSS()
+	cgroup := cgroupMemory()
+	disk := dirSize(s.dir)
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.usage.PeakRSS = max(s.usage.PeakRSS, rss)
+	s.usage.PeakCgroup = max(s.usage.PeakCgroup, cgroup)
+	if disk > s.disk0 {
+		s.usage.PeakTempDisk = max(s.usage.PeakTempDisk, disk-s.disk0)
+	}
+}
+
+// Stop ends sampling and returns the usage since startSampler.
+func (s *resourceSampler) Stop() ResourceUsage {
+	close(s.stop)
+	<-s.done
+	s.sample()
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	usage := s.usage
+	usage.Duration = time.Since(s.start)
+	usage.CPUTime = processCPUTime() - s.cpu0
+	if usage.Duration > 0 {
+		usage.CPUPercent = float64(usage.CPUTime) / float64(usage.Duration) * 100
+	}
+	read, written := processIO()
+	usage.ReadBytes = read - min(read, s.read0)
+	usage.WriteBytes = written - min(written, s.written0)
+	return usage
+}
+
+// usageMeter samples the process for every phase running at the time with a single sampling
+// loop, however many phases run at once. The cpu time and io of every interval are split evenly
+// between the phases running in it, so that the phases add up to what the process used; peaks
+// are those of the whole process while a phase ran.
+type usageMeter struct {
+	dir  string
+	stop chan struct{}
+	done chan struct{}
+
+	lk            sync.Mutex
+	spans         map[*usageSpan]struct{}
+	cpu           time.Duration
+	read, written uint64
+	disk          uint64
+	diskAt        time.Time
+}
+
+// usageSpan is a phase measured by a usageMeter.
+type usageSpan struct {
+	start time.Time
+	disk0 uint64
+	usage ResourceUsage
+}
+
+// startUsageMeter starts sampling, dir is the working directory whose growth is tracked, empty
+// to not track any.
+func startUsageMeter(dir string) *usageMeter {
+	m := &usageMeter{
+		dir:    dir,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		spans:  make(map[*usageSpan]struct{}),
+		cpu:    processCPUTime(),
+		disk:   dirSize(dir),
+		diskAt: time.Now(),
+	}
+	m.read, m.written = processIO()
+
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.lk.Lock()
+				m.advance()
+				m.lk.Unlock()
+			}
+		}
+	}()
+	return m
+}
+
+// advance attributes the usage since its last call to the running spans. The working directory
+// is walked at most once per sampleInterval.
+func (m *usageMeter) advance() {
+	cpu := processCPUTime()
+	read, written := processIO()
+	rss, cgroup := processRSS(), cgroupMemory()
+	if time.Since(m.diskAt) >= sampleInterval {
+		m.disk, m.diskAt = dirSize(m.dir), time.Now()
+	}
+
+	if n := len(m.spans); n > 0 {
+		cpuShare := max(cpu-m.cpu, 0) / time.Duration(n)
+		readShare := (read - min(read, m.read)) / uint64(n)
+		writtenShare := (written - min(written, m.written)) / uint64(n)
+		for s := range m.spans {
+			s.usage.CPUTime += cpuShare
+			s.usage.ReadBytes += readShare
+			s.usage.WriteBytes += writtenShare
+			s.usage.PeakRSS = max(s.usage.PeakRSS, rss)
+			s.usage.PeakCgroup = max(s.usage.PeakCgroup, cgroup)
+			if m.disk > s.disk0 {
+				s.usage.PeakTempDisk = max(s.usage.PeakTempDisk, m.disk-s.disk0)
+			}
+		}
+	}
+	m.cpu, m.read, m.written = cpu, read, written
+}
+
+// Start starts measuring a phase.
+func (m *usageMeter) Start() *usageSpan {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.advance()
+	s := &usageSpan{start: time.Now(), disk0: m.disk}
+	m.spans[s] = struct{}{}
+	return s
+}
+
+// Stop ends measuring the phase of s and returns its share of the usage.
+func (m *usageMeter) Stop(s *usageSpan) ResourceUsage {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.advance()
+	delete(m.spans, s)
+
+	usage := s.usage
+	usage.Duration = time.Since(s.start)
+	if usage.Duration > 0 {
+		usage.CPUPercent = float64(usage.CPUTime) / float64(usage.Duration) * 100
+	}
+	return usage
+}
+
+// Close stops the sampling loop.
+func (m *usageMeter) Close() {
+	close(m.stop)
+	<-m.done
+}
+
+// processCPUTime returns the user and system time of the process from /proc/self/stat.
+func processCPUTime() time.Duration {
+	data, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return 0
+	}
+	// the command name may contain spaces, fields are counted from after it
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 13 {
+		return 0
+	}
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	return time.Duration(utime+stime) * time.Second / clockTicks
+}
+
+// processRSS returns the resident memory of the process in bytes.
+func processRSS() uint64 {
+	return procKB("/proc/self/status", "VmRSS")
+}
+
+// processIO returns the bytes the process read from and wrote to storage, zero when
+// /proc/self/io is not readable.
+func processIO() (read, written uint64) {
+	read, _ = strconv.ParseUint(procField("/proc/self/io", "read_bytes"), 10, 64)
+	written, _ = strconv.ParseUint(procField("/proc/self/io", "write_bytes"), 10, 64)
+	return read, written
+}
+
+// cgroupMemory returns the memory charged to the process' own cgroup, from cgroup v2 or the
+// v1 memory controller.
+func cgroupMemory() uint64 {
+	for _, path := range cgroupMemoryFiles() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil {
+			return v
+		}
+	}
+	return 0
+}
+
+// cgroupMemoryFiles returns the usage files of the process' cgroup listed in /proc/self/cgroup,
+// from the "0::<path>" line of cgroup v2 and the line of the v1 memory controller.
+func cgroupMemoryFiles() []string {
+	data, _ := os.ReadFile("/proc/self/cgroup")
+	var files []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// hierarchy-id:controllers:path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		switch {
+		case parts[0] == "0" && parts[1] == "":
+			files = append(files, filepath.Join("/sys/fs/cgroup", parts[2], "memory.current"))
+		case hasController(parts[1], "memory"):
+			files = append(files, filepath.Join("/sys/fs/cgroup/memory", parts[2], "memory.usage_in_bytes"))
+		}
+	}
+	// without a cgroup namespace a container sees host paths that do not exist in its own
+	// mount, whose root is then the container's cgroup
+	return append(files, "/sys/fs/cgroup/memory.current", "/sys/fs/cgroup/memory/memory.usage_in_bytes")
+}
+
+func hasController(controllers, name string) bool {
+	for _, c := range strings.Split(controllers, ",") {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func procKB(path, key string) uint64 {
+	kb, err := strconv.ParseUint(strings.TrimSuffix(procField(path, key), " kB"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return kb * 1024
+}
+
+// dirSize returns the size of the files below dir.
+func dirSize(dir string) uint64 {
+	if dir == "" {
+		return 0
+	}
+	var size uint64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	prooftypes "github.com/filecoin-project/go-state-types/proof"
+	lapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/storage/sealer/ffiwrapper"
+	"github.com/filecoin-project/lotus/storage/sealer/storiface"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/xerrors"
+)
+
+// ParCfg is the number of sectors every sealing phase works on at once.
+type ParCfg struct {
+	AddPiece   int
+	PreCommit1 int
+	PreCommit2 int
+	Commit     bool // run Commit1, Commit2 and verification after PreCommit2
+	Commit1    int
+	Commit2    int
+}
+
+func (p ParCfg) validate() error {
+	if p.AddPiece < 1 || p.PreCommit1 < 1 || p.PreCommit2 < 1 {
+		return xerrors.Errorf("AddPiece, PreCommit1 and PreCommit2 concurrency must be at least 1")
+	}
+	if p.Commit && (p.Commit1 < 1 || p.Commit2 < 1) {
+		return xerrors.Errorf("Commit1 and Commit2 concurrency must be at least 1")
+	}
+	return nil
+}
+
+// benchSeed is the interactive randomness of the benchmark's commit phases, the same lotus-bench uses.
+var benchSeed = lapi.SealSeed{
+	Epoch: 101,
+	Value: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 255},
+}
+
+// sealJob is a sector moving through the sealing phases.
+type sealJob struct {
+	sid    storiface.SectorRef
+	timing *SealingResult
+	queued time.Time // when the sector entered the queue of its current phase
+
+	piece abi.PieceInfo
+	pc1o  storiface.PreCommit1Out
+	c1in  *Commit1In
+	c1o   storiface.Commit1Out
+	proof []byte
+}
+
+// sealPhase is a step of the sealing pipeline with its own pool of workers. An idle worker
+// takes whichever sector is ready next, so a slow sector does not hold up the others.
+type sealPhase struct {
+	name    string
+	workers int
+	run     func(ctx context.Context, job *sealJob) error
+	timing  func(r *SealingResult) (took, wait *time.Duration)
+}
+
+func runSeals(ctx context.Context, sb *ffiwrapper.Sealer, numSectors int, par ParCfg, mid abi.ActorID, sectorSize abi.SectorSize, ticketPreimage []byte, sbdir string) ([]SealingResult, []prooftypes.ExtendedSectorInfo, error) {
+	if err := par.validate(); err != nil {
+		return nil, nil, err
+	}
+	sealTimings := make([]SealingResult, numSectors)
+	trand := blake2b.Sum256(ticketPreimage)
+	ticket := abi.SealRandomness(trand[:])
+
+	phases := []sealPhase{
+		{
+			name:    "addPiece",
+			workers: par.AddPiece,
+			run: func(ctx context.Context, job *sealJob) error {
+				log.Infof("[%d] Writing piece into sector...", job.sid.ID.Number)
+				r := rand.New(rand.NewSource(100 + int64(job.sid.ID.Number)))
+				pi, err := sb.AddPiece(ctx, job.sid, nil, abi.PaddedPieceSize(sectorSize).Unpadded(), r)
+				job.piece = pi
+				return err
+			},
+			timing: func(r *SealingResult) (*time.Duration, *time.Duration) { return &r.AddPiece, &r.AddPieceWait },
+		},
+		{
+			name:    "preCommit1",
+			workers: par.PreCommit1,
+			run: func(ctx context.Context, job *sealJob) error {
+				log.Infof("[%d] Running replication(1)...", job.sid.ID.Number)
+				pc1o, err := sb.SealPreCommit1(ctx, job.sid, ticket, []abi.PieceInfo{job.piece})
+				job.pc1o = pc1o
+				return err
+			},
+			timing: func(r *SealingResult) (*time.Duration, *time.Duration) { return &r.PreCommit1, &r.PreCommit1Wait },
+		},
+		{
+			name:    "preCommit2",
+			workers: par.PreCommit2,
+			run: func(ctx context.Context, job *sealJob) error {
+				log.Infof("[%d] Running replication(2)...", job.sid.ID.Number)
+				cids, err := sb.SealPreCommit2(ctx, job.sid, job.pc1o)
+				if err != nil {
+					return err
+				}
+				job.pc1o = nil
+				job.c1in = &Commit1In{
+					Sid:        job.sid,
+					Ticket:     ticket,
+					Piece:      []abi.PieceInfo{job.piece},
+					Cids:       cids,
+					SectorSize: sectorSize,
+				}
+				return nil
+			},
+			timing: func(r *SealingResult) (*time.Duration, *time.Duration) { return &r.PreCommit2, &r.PreCommit2Wait },
+		},
+	}
+	if par.Commit {
+		phases = append(phases, sealPhase{
+			name:    "commit1",
+			workers: par.Commit1,
+			run: func(ctx context.Context, job *sealJob) error {
+				log.Infof("[%d] Running commit(1)...", job.sid.ID.Number)
+				c1in := job.c1in
+				c1o, err := sb.SealCommit1(ctx, c1in.Sid, c1in.Ticket, benchSeed.Value, c1in.Piece, c1in.Cids)
+				job.c1o = c1o
+				return err
+			},
+			timing: func(r *SealingResult) (*time.Duration, *time.Duration) { return &r.Commit1, &r.Commit1Wait },
+		}, sealPhase{
+			name:    "commit2",
+			workers: par.Commit2,
+			run: func(ctx context.Context, job *sealJob) error {
+				log.Infof("[%d] Running commit(2)...", job.sid.ID.Number)
+				proof, err := sb.SealCommit2(ctx, job.sid, job.c1o)
+				job.c1o = nil
+				job.proof = proof
+				return err
+			},
+			timing: func(r *SealingResult) (*time.Duration, *time.Duration) { return &r.Commit2, &r.Commit2Wait },
+		}, sealPhase{
+			// verification is a phase of its own so that it is not counted into Commit2
+			name:    "verify",
+			workers: par.Commit2,
+			run: func(ctx context.Context, job *sealJob) error {
+				log.Infof("[%d] Verifying proof...", job.sid.ID.Number)
+				ok, err := ffiwrapper.ProofVerifier.VerifySeal(prooftypes.SealVerifyInfo{
+					SectorID:              job.sid.ID,
+					SealedCID:             job.c1in.Cids.Sealed,
+					SealProof:             job.sid.ProofType,
+					Proof:                 job.proof,
+					Randomness:            job.c1in.Ticket,
+					InteractiveRandomness: benchSeed.Value,
+					UnsealedCID:           job.c1in.Cids.Unsealed,
+				})
+				if err != nil {
+					return xerrors.Errorf("verify: %w", err)
+				}
+				if !ok {
+					return xerrors.Errorf("proof for sector %d was invalid", job.sid.ID.Number)
+				}
+				job.proof = nil
+				return nil
+			},
+			timing: func(r *SealingResult) (*time.Duration, *time.Duration) { return &r.Verify, &r.VerifyWait },
+		})
+	}
+
+	jobs := make([]*sealJob, numSectors)
+	for i := range jobs {
+		jobs[i] = &sealJob{
+			sid: storiface.SectorRef{
+				ID: abi.SectorID{
+					Miner:  mid,
+					Number: abi.SectorNumber(i),
+				},
+				ProofType: spt(sectorSize, false),
+			},
+			timing: &sealTimings[i],
+		}
+	}
+	if err := runSealPhases(ctx, phases, jobs, sbdir); err != nil {
+		return nil, nil, err
+	}
+
+	sealedSectors := make([]prooftypes.ExtendedSectorInfo, numSectors)
+	for i, job := range jobs {
+		sealedSectors[i] = prooftypes.ExtendedSectorInfo{
+			SealProof:    job.sid.ProofType,
+			SectorNumber: job.sid.ID.Number,
+			SealedCID:    job.c1in.Cids.Sealed,
+			SectorKey:    nil,
+		}
+
+		bytes, err := json.Marshal(job.c1in)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileName := filepath.Join(filepath.Dir(sbdir), fmt.Sprintf("c1in-%d-%s.json", mid, job.sid.ID.Number.String()))
+		if err = os.WriteFile(fileName, bytes, 0644); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sealTimings, sealedSectors, nil
+}
+
+// runSealPhases moves every job through the phases in order, recording how long each phase
+// took, how long the job waited for a worker and its share of the resources used while it ran;
+// dir is the working directory whose growth counts as temp disk. The first error stops all phases.
+func runSealPhases(ctx context.Context, phases []sealPhase, jobs []*sealJob, dir string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	meter := startUsageMeter(dir)
+	defer meter.Close()
+
+	var (
+		errOnce  sync.Once
+		firstErr error
+	)
+	queues := make([]chan *sealJob, len(phases)+1)
+	for i := range queues {
+		queues[i] = make(chan *sealJob, len(jobs))
+	}
+
+	var wgs = make([]sync.WaitGroup, len(phases))
+	for i, phase := range phases {
+		for w := 0; w < phase.workers; w++ {
+			wgs[i].Add(1)
+			go func() {
+				defer wgs[i].Done()
+				for job := range queues[i] {
+					if ctx.Err() != nil {
+						continue
+					}
+					took, wait := phase.timing(job.timing)
+					*wait = time.Since(job.queued)
+					start := time.Now()
+					span := meter.Start()
+					err := phase.run(ctx, job)
+					usage := meter.Stop(span)
+					if job.timing.Resources == nil {
+						job.timing.Resources = make(map[string]ResourceUsage)
+					}
+					job.timing.Resources[phase.name] = usage
+					if err != nil {
+						errOnce.Do(func() {
+							firstErr = xerrors.Errorf("[%d] %s: %w", job.sid.ID.Number, phase.name, err)
+							cancel()
+						})
+						continue
+					}
+					*took = time.Since(start)
+					job.queued = time.Now()
+					queues[i+1] <- job
+				}
+			}()
+		}
+	}
+
+	now := time.Now()
+	for _, job := range jobs {
+		job.queued = now
+		queues[0] <- job
+	}
+	close(queues[0])
+	for i := range phases {
+		wgs[i].Wait()
+		close(queues[i+1])
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
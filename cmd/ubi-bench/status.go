@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/swanchain/ubi-benchmark/utils"
+)
+
+const defaultRecentTasks = 50
+
+// daemonStatus remembers what the daemon last saw of its backends and the hub, for the
+// /healthz and /status endpoints.
+type daemonStatus struct {
+	started time.Time
+
+	lk       sync.Mutex
+	backends map[string]*BackendStatus
+	hub      map[int]*HubStatus // source -> last task stats
+	chain    *ChainStatus       // nil when not following a chain
+}
+
+type BackendStatus struct {
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+type HubStatus struct {
+	Stats       ResourceCountList `json:"stats"`
+	LastSuccess time.Time         `json:"last_success"`
+	LastFailure time.Time         `json:"last_failure"`
+	LastError   string            `json:"last_error,omitempty"`
+}
+
+type ChainStatus struct {
+	Head        int64     `json:"head"`
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+type DaemonStatus struct {
+	Started     time.Time                `json:"started"`
+	NextHeights map[string]int64         `json:"next_heights"` // sector type -> height cursor
+	Chain       *ChainStatus             `json:"chain,omitempty"`
+	Backends    map[string]BackendStatus `json:"backends"`
+	Hub         map[string]HubStatus     `json:"hub"` // by source
+	InFlight    map[string]string        `json:"in_flight"`
+	Stages      map[string]int           `json:"stages"` // tasks per pipeline stage
+	Unfinished  int                      `json:"unfinished"`
+}
+
+// TaskSummary is what /tasks/recent shows of a task. It leaves out the uploaded urls and the
+// task template, presigned urls grant access to the artifacts.
+type TaskSummary struct {
+	TaskDir    string     `json:"task_dir"`
+	SectorType int64      `json:"sector_type"`
+	Height     int64      `json:"height"`
+	Status     TaskStatus `json:"status"`
+	Store      string     `json:"store"`
+	Copies     int        `json:"copies"`
+	Submitted  int        `json:"submitted"`
+	UploadedTo []string   `json:"uploaded_to,omitempty"`
+	Attempts   int        `json:"attempts"` // failed attempts
+	NextRetry  *time.Time `json:"next_retry,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func summarizeTask(rec TaskRecord) TaskSummary {
+	sum := TaskSummary{
+		TaskDir:    rec.TaskDir,
+		SectorType: rec.SectorType,
+		Height:     rec.Height,
+		Status:     rec.Status,
+		Store:      rec.Store,
+		Copies:     rec.Copies,
+		Submitted:  rec.Submitted,
+		Attempts:   rec.Attempts,
+		LastError:  utils.Redact(rec.LastError),
+		CreatedAt:  rec.CreatedAt,
+		UpdatedAt:  rec.UpdatedAt,
+	}
+	if !rec.Status.finished() && rec.NextAttempt.After(time.Now()) {
+		sum.NextRetry = &rec.NextAttempt
+	}
+	for store := range rec.Uploads {
+		sum.UploadedTo = append(sum.UploadedTo, store)
+	}
+	sort.Strings(sum.UploadedTo)
+	return sum
+}
+
+func newDaemonStatus() *daemonStatus {
+	return &daemonStatus{
+		started:  time.Now(),
+		backends: make(map[string]*BackendStatus),
+		hub:      make(map[int]*HubStatus),
+	}
+}
+
+func (s *daemonStatus) storeResult(store string, err error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	st, ok := s.backends[store]
+	if !ok {
+		st = new(BackendStatus)
+		s.backends[store] = st
+	}
+	if err != nil {
+		st.LastFailure = time.Now()
+		st.LastError = err.Error()
+		return
+	}
+	st.LastSuccess = time.Now()
+}
+
+func (s *daemonStatus) hubResult(source int, stats *TaskStats, err error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	st, ok := s.hub[source]
+	if !ok {
+		st = new(HubStatus)
+		s.hub[source] = st
+	}
+	if err != nil {
+		st.LastFailure = time.Now()
+		st.LastError = err.Error()
+		return
+	}
+	st.Stats = append(ResourceCountList(nil), stats.Data...)
+	st.LastSuccess = time.Now()
+}
+
+func (s *daemonStatus) chainResult(head int64, err error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.chain == nil {
+		s.chain = new(ChainStatus)
+	}
+	if err != nil {
+		s.chain.LastFailure = time.Now()
+		s.chain.LastError = err.Error()
+		return
+	}
+	s.chain.Head = head
+	s.chain.LastSuccess = time.Now()
+}
+
+// status collects a snapshot of the daemon's state.
+func (d *daemon) status() DaemonStatus {
+	out := DaemonStatus{
+		Started:     d.stat.started,
+		NextHeights: make(map[string]int64),
+		Backends:    make(map[string]BackendStatus),
+		Hub:         make(map[string]HubStatus),
+		InFlight:    d.pipeline.snapshot(),
+		Stages:      make(map[string]int),
+		Unfinished:  len(d.ledger.Unfinished()),
+	}
+	for _, tmpl := range d.templates {
+		out.NextHeights[strconv.FormatInt(tmpl.sectorType, 10)] = d.ledger.NextHeight(tmpl.sectorType)
+	}
+	for _, stage := range out.InFlight {
+		out.Stages[stage]++
+	}
+
+	d.stat.lk.Lock()
+	defer d.stat.lk.Unlock()
+	for _, supplier := range d.suppliers {
+		out.Backends[supplier.store.Name()] = BackendStatus{}
+	}
+	for name, st := range d.stat.backends {
+		out.Backends[name] = *st
+	}
+	for source, st := range d.stat.hub {
+		out.Hub[strconv.Itoa(source)] = *st
+	}
+	if d.stat.chain != nil {
+		chain := *d.stat.chain
+		out.Chain = &chain
+	}
+	return out
+}
+
+// health returns the reasons the daemon is unhealthy: a hub source without successful task
+// stats or a followed chain without a head for three check intervals means the daemon has
+// stopped supplying tasks.
+func (d *daemon) health() []string {
+	stale := 3 * time.Duration(utils.GetConfig().HUB.CheckInterval) * time.Minute
+	if time.Since(d.stat.started) < stale {
+		return nil
+	}
+
+	d.stat.lk.Lock()
+	defer d.stat.lk.Unlock()
+	var problems []string
+	for _, supplier := range d.suppliers {
+		st, ok := d.stat.hub[supplier.source]
+		if !ok || time.Since(st.LastSuccess) > stale {
+			problems = append(problems, "no task stats from the hub for source "+strconv.Itoa(supplier.source)+" since "+stale.String())
+		}
+	}
+	if d.chain != nil && (d.stat.chain == nil || time.Since(d.stat.chain.LastSuccess) > stale) {
+		problems = append(problems, "no head from the "+d.chain.Name()+" chain since "+stale.String())
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// serveDaemonAPI serves on addr until ctx is done: /metrics with metrics set, /healthz, /status
+// and /tasks/recent with status set.
+func serveDaemonAPI(ctx context.Context, addr string, d *daemon, metrics, status bool) error {
+	mux := http.NewServeMux()
+	if metrics {
+		mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	}
+	if status {
+		d.handleStatus(mux)
+	}
+
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	log.Infof("serving daemon api on %s, metrics: %t, status: %t", addr, metrics, status)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (d *daemon) handleStatus(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		problems := d.health()
+		if len(problems) > 0 {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unhealthy", "problems": problems})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.status())
+	})
+	mux.HandleFunc("/tasks/recent", func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultRecentTasks
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "limit must be a positive integer"})
+				return
+			}
+			limit = n
+		}
+		recent := d.ledger.Recent(limit)
+		tasks := make([]TaskSummary, 0, len(recent))
+		for _, rec := range recent {
+			tasks = append(tasks, summarizeTask(rec))
+		}
+		writeJSON(w, http.StatusOK, tasks)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
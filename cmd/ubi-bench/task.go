@@ -1,12 +1,5 @@
 package main
 
-import (
-	"bytes"
-	"encoding/json"
-	"github.com/swanchain/ubi-benchmark/utils"
-	"net/http"
-)
-
 const (
 	CPU512 = 1
 	CPU32G = 2
@@ -24,35 +17,6 @@ type Task struct {
 	Source       int    `json:"source"`
 }
 
-func DoSend(task Task) {
-	jsonData, err := json.Marshal(task)
-	if err != nil {
-		log.Errorf("JSON encoding failed: %v", err)
-		return
-	}
-	log.Infof("send req: %s", string(jsonData))
-
-	url := utils.GetConfig().HUB.HubUrl
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Errorf("POST request failed: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		log.Infof("Request successful, status code: %d", resp.StatusCode)
-	} else {
-		log.Errorf("Request failed, status code: %d", resp.StatusCode)
-
-		// Read the error response
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(resp.Body)
-		errBody := buf.String()
-		log.Infof("Error message: %s", errBody)
-	}
-}
-
 type TaskStats struct {
 	Code int               `json:"code"`
 	Msg  string            `json:"msg"`
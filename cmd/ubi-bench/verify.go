@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	prooftypes "github.com/filecoin-project/go-state-types/proof"
+	"github.com/filecoin-project/lotus/storage/sealer/ffiwrapper"
+	"github.com/swanchain/ubi-benchmark/utils"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+const (
+	VerifyValid   = "valid"
+	VerifyInvalid = "invalid"
+	VerifyError   = "error"
+)
+
+// C2Proof is the output of `ubi-bench c2`: the SealVerifyInfo plus the epoch the seed was drawn at.
+// The SealVerifyInfo fields stay at the top level, so readers of the bare SealVerifyInfo c2 wrote
+// before still parse it, and a bare SealVerifyInfo parses as a C2Proof without SeedEpoch.
+type C2Proof struct {
+	prooftypes.SealVerifyInfo
+	SeedEpoch int64 `json:",omitempty"`
+}
+
+// VerifyReport is the result of `ubi-bench verify batch`.
+type VerifyReport struct {
+	Created time.Time
+	Total   int
+	Valid   int
+	Invalid int
+	Errored int
+	Results []VerifyResult
+}
+
+type VerifyResult struct {
+	Source string // file, or stream and line number
+	Miner  abi.ActorID
+	Sector abi.SectorNumber
+	Height int64
+	Status string // valid, invalid or error
+	Reason string `json:",omitempty"`
+}
+
+// verifyInput is a proof waiting to be verified, height is taken from the file name when the
+// proof does not carry its seed epoch.
+type verifyInput struct {
+	index  int
+	source string
+	data   []byte
+	height int64
+}
+
+var verifyBatchCmd = &cli.Command{
+	Name:      "batch",
+	Usage:     "Verify a directory of c2-*.json proofs, or a JSONL stream of them, and report the results",
+	ArgsUsage: "<directory|file.jsonl|->",
+	Flags: append([]cli.Flag{
+		&cli.IntFlag{
+			Name:  "parallel",
+			Usage: "number of proofs verified at once",
+			Value: runtime.NumCPU(),
+		},
+		&cli.StringFlag{
+			Name:  "out",
+			Usage: "write the json report to this file instead of stdout",
+		},
+	}, randomnessFlags...),
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return xerrors.Errorf("Usage: ubi-bench verify batch <directory|file.jsonl|->")
+		}
+		if c.Int("parallel") < 1 {
+			return xerrors.Errorf("--parallel must be at least 1")
+		}
+
+		source, err := randomnessSource(c)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+
+		inputs := make(chan verifyInput)
+		readErr := make(chan error, 1)
+		go func() {
+			defer close(inputs)
+			readErr <- readVerifyInputs(c.Args().First(), inputs)
+		}()
+
+		var (
+			lk      sync.Mutex
+			results []indexedResult
+			wg      sync.WaitGroup
+		)
+		for i := 0; i < c.Int("parallel"); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for in := range inputs {
+					res := verifyProof(c, source, in)
+					log.Infof("%s: sector %d, height %d: %s %s", res.Source, res.Sector, res.Height, res.Status, res.Reason)
+					lk.Lock()
+					results = append(results, indexedResult{in.index, res})
+					lk.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if err := <-readErr; err != nil {
+			return err
+		}
+
+		sort.Slice(results, func(i, j int) bool { return results[i].index < results[j].index })
+		report := VerifyReport{Created: time.Now(), Total: len(results)}
+		for _, r := range results {
+			switch r.Status {
+			case VerifyValid:
+				report.Valid++
+			case VerifyInvalid:
+				report.Invalid++
+			default:
+				report.Errored++
+			}
+			report.Results = append(report.Results, r.VerifyResult)
+		}
+
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if out := c.String("out"); out != "" {
+			if err := os.WriteFile(out, data, 0644); err != nil {
+				return xerrors.Errorf("writing report: %w", err)
+			}
+		} else {
+			fmt.Println(string(data))
+		}
+
+		if report.Total == 0 {
+			return xerrors.Errorf("no proofs found in %s", c.Args().First())
+		}
+		if report.Invalid > 0 || report.Errored > 0 {
+			return xerrors.Errorf("%d of %d proofs valid, %d invalid, %d errored", report.Valid, report.Total, report.Invalid, report.Errored)
+		}
+		return nil
+	},
+}
+
+type indexedResult struct {
+	index int
+	VerifyResult
+}
+
+// readVerifyInputs sends the proofs of path to inputs: the c2-*.json files of a directory, or
+// one proof per line of a JSONL file or, for "-", of stdin.
+func readVerifyInputs(path string, inputs chan<- verifyInput) error {
+	if path != "-" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			files, err := filepath.Glob(filepath.Join(path, "c2-*.json"))
+			if err != nil {
+				return err
+			}
+			for i, file := range files {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					return xerrors.Errorf("reading %s: %w", file, err)
+				}
+				inputs <- verifyInput{index: i, source: file, data: data, height: c2FileEpoch(file)}
+			}
+			return nil
+		}
+	}
+
+	var r io.Reader = os.Stdin
+	name := "stdin"
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r, name = f, path
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		inputs <- verifyInput{index: line, source: fmt.Sprintf("%s:%d", name, line), data: append([]byte(nil), data...)}
+	}
+	if err := scanner.Err(); err != nil {
+		return xerrors.Errorf("reading %s: %w", name, err)
+	}
+	return nil
+}
+
+// c2FileEpoch returns the seed epoch in a c2-<miner>-<sector>-<epoch>.json file name, 0 if
+// the name has none.
+func c2FileEpoch(file string) int64 {
+	var miner, sector, epoch int64
+	name := strings.TrimSuffix(filepath.Base(file), ".json")
+	if _, err := fmt.Sscanf(name, "c2-%d-%d-%d", &miner, &sector, &epoch); err != nil {
+		return 0
+	}
+	return epoch
+}
+
+// verifyProof checks one proof against the seed of its height.
+func verifyProof(c *cli.Context, source utils.RandomnessSource, in verifyInput) VerifyResult {
+	res := VerifyResult{Source: in.source, Height: in.height}
+	fail := func(status, format string, args ...interface{}) VerifyResult {
+		res.Status = status
+		res.Reason = fmt.Sprintf(format, args...)
+		return res
+	}
+
+	var proof C2Proof
+	if err := json.Unmarshal(in.data, &proof); err != nil {
+		return fail(VerifyError, "unmarshalling proof: %s", err)
+	}
+	svi := proof.SealVerifyInfo
+	res.Miner, res.Sector = svi.SectorID.Miner, svi.SectorID.Number
+	if proof.SeedEpoch != 0 {
+		res.Height = proof.SeedEpoch
+	}
+	if res.Height <= 0 {
+		return fail(VerifyError, "no seed epoch in the proof or its file name")
+	}
+
+	res.Status, res.Reason = checkSeal(c.Context, source, svi, res.Height)
+	return res
+}
+
+// checkSeal verifies svi against the seed source draws for height, the check behind verify,
+// verify batch and serve-verify. A seed in svi that differs from the drawn one makes the proof
+// invalid. It returns the status and, unless the proof is valid, the reason.
+func checkSeal(ctx context.Context, source utils.RandomnessSource, svi prooftypes.SealVerifyInfo, height int64) (string, string) {
+	maddr, err := address.NewIDAddress(uint64(svi.SectorID.Miner))
+	if err != nil {
+		return VerifyError, fmt.Sprintf("miner address: %s", err)
+	}
+	randomness, err := source.GetRandomness(ctx, maddr, crypto.DomainSeparationTag_InteractiveSealChallengeSeed, height)
+	if err != nil {
+		return VerifyError, fmt.Sprintf("getting randomness: %s", err)
+	}
+	if len(svi.InteractiveRandomness) > 0 && !bytes.Equal(svi.InteractiveRandomness, randomness) {
+		return VerifyInvalid, fmt.Sprintf("seed does not match the %s randomness of height %d", source.Name(), height)
+	}
+	svi.InteractiveRandomness = randomness
+
+	ok, err := ffiwrapper.ProofVerifier.VerifySeal(svi)
+	if err != nil {
+		return VerifyError, fmt.Sprintf("verifying: %s", err)
+	}
+	if !ok {
+		return VerifyInvalid, "proof does not verify"
+	}
+	return VerifyValid, ""
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/swanchain/ubi-benchmark/utils"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+const maxVerifyRequest = 4 << 20
+
+// VerifyRequest is the body of POST /verify: the proof `ubi-bench c2` writes and the
+// c1out-*-verify.json of the task it answers.
+type VerifyRequest struct {
+	Proof C2Proof
+	Task  Commit2In
+}
+
+var serveVerifyCmd = &cli.Command{
+	Name:  "serve-verify",
+	Usage: "Serve an http api that verifies C2 proofs against their tasks",
+	Description: "POST /verify takes {\"Proof\": <c2-*.json>, \"Task\": <c1out-*-verify.json>} and answers with\n" +
+		"the status valid, invalid or error and the reason. The seed is drawn again for the task's\n" +
+		"height from the randomness source, exactly as `ubi-bench verify` does. GET /healthz reports\n" +
+		"whether the service is up.\n\n" +
+		"With --token every /verify request needs the header \"Authorization: Bearer <token>\". The api\n" +
+		"is only served on other than a loopback address with a token.",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "listen",
+			Usage: "address to serve the api on",
+			Value: "127.0.0.1:9200",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "bearer token /verify requests must carry",
+			EnvVars: []string{"UBI_VERIFY_TOKEN"},
+		},
+		&cli.IntFlag{
+			Name:  "parallel",
+			Usage: "number of proofs verified at once, further requests wait",
+			Value: runtime.NumCPU(),
+		},
+	}, randomnessFlags...),
+	Action: func(c *cli.Context) error {
+		if c.Int("parallel") < 1 {
+			return xerrors.Errorf("--parallel must be at least 1")
+		}
+		token := c.String("token")
+		if token == "" && !loopbackAddr(c.String("listen")) {
+			return xerrors.Errorf("refusing to serve on %s without --token, anyone reaching it could use up the verifier", c.String("listen"))
+		}
+		source, err := randomnessSource(c)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+
+		slots := make(chan struct{}, c.Int("parallel"))
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "randomness": source.Name()})
+		})
+		mux.HandleFunc("/verify", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "use POST"})
+				return
+			}
+			var req VerifyRequest
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxVerifyRequest))
+			if err := dec.Decode(&req); err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					writeJSON(w, http.StatusRequestEntityTooLarge, VerifyResult{Status: VerifyError, Reason: fmt.Sprintf("request is larger than %d bytes", tooLarge.Limit)})
+					return
+				}
+				writeJSON(w, http.StatusBadRequest, VerifyResult{Status: VerifyError, Reason: fmt.Sprintf("unmarshalling request: %s", err)})
+				return
+			}
+			if req.Task.Seed.Epoch <= 0 {
+				writeJSON(w, http.StatusBadRequest, VerifyResult{Status: VerifyError, Reason: "the task has no seed epoch"})
+				return
+			}
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-r.Context().Done():
+				return
+			}
+			start := time.Now()
+			res := verifyTaskProof(r.Context(), source, req)
+			log.Infof("verify %s: sector %d of miner %d, height %d: %s %s (%s)", r.RemoteAddr, res.Sector, res.Miner, res.Height,
+				res.Status, res.Reason, time.Since(start).Round(time.Millisecond))
+			code := http.StatusOK
+			if res.Status == VerifyError {
+				code = http.StatusInternalServerError
+			}
+			writeJSON(w, code, res)
+		}))
+
+		srv := &http.Server{Addr: c.String("listen"), Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		ctx, cancel := context.WithCancel(c.Context)
+		defer cancel()
+		go func() {
+			<-ctx.Done()
+			_ = srv.Close()
+		}()
+
+		log.Infof("serving proof verification on %s, randomness from %s, token required: %t", c.String("listen"), source.Name(), token != "")
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	},
+}
+
+// requireToken answers requests without "Authorization: Bearer <token>" with 401. An empty token
+// lets every request through.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "missing or wrong bearer token"})
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// loopbackAddr reports whether a listen address only accepts connections from this host.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// verifyTaskProof checks that the proof answers the task and then verifies it for the task's
+// height. A proof for another sector, ticket or seed is invalid.
+func verifyTaskProof(ctx context.Context, source utils.RandomnessSource, req VerifyRequest) VerifyResult {
+	svi, task := req.Proof.SealVerifyInfo, req.Task
+	res := VerifyResult{Source: "request", Miner: svi.SectorID.Miner, Sector: svi.SectorID.Number, Height: int64(task.Seed.Epoch)}
+	invalid := func(format string, args ...interface{}) VerifyResult {
+		res.Status = VerifyInvalid
+		res.Reason = fmt.Sprintf(format, args...)
+		return res
+	}
+
+	switch {
+	case res.Height <= 0:
+		res.Status, res.Reason = VerifyError, "the task has no seed epoch"
+		return res
+	case svi.SectorID != task.Sid.ID:
+		return invalid("proof is for sector %d of miner %d, the task for sector %d of miner %d",
+			svi.SectorID.Number, svi.SectorID.Miner, task.Sid.ID.Number, task.Sid.ID.Miner)
+	case svi.SealProof != task.Sid.ProofType:
+		return invalid("proof type %d does not match the task's %d", svi.SealProof, task.Sid.ProofType)
+	case !svi.SealedCID.Equals(task.Cids.Sealed) || !svi.UnsealedCID.Equals(task.Cids.Unsealed):
+		return invalid("sector cids do not match the task")
+	case !bytes.Equal(svi.Randomness, task.Ticket):
+		return invalid("ticket does not match the task")
+	case req.Proof.SeedEpoch != 0 && req.Proof.SeedEpoch != res.Height:
+		return invalid("proof seed epoch %d does not match the task's %d", req.Proof.SeedEpoch, res.Height)
+	case len(task.Seed.Value) > 0 && len(svi.InteractiveRandomness) > 0 && !bytes.Equal(svi.InteractiveRandomness, task.Seed.Value):
+		return invalid("seed does not match the task")
+	}
+
+	res.Status, res.Reason = checkSeal(ctx, source, svi, res.Height)
+	return res
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	prooftypes "github.com/filecoin-project/go-state-types/proof"
+)
+
+func TestC2ProofFormats(t *testing.T) {
+	svi := prooftypes.SealVerifyInfo{
+		SealProof:             abi.RegisteredSealProof_StackedDrg2KiBV1_1,
+		SectorID:              abi.SectorID{Miner: 1000, Number: 7},
+		Randomness:            abi.SealRandomness{1, 2, 3},
+		InteractiveRandomness: abi.InteractiveSealRandomness{4, 5, 6},
+		Proof:                 []byte{7, 8, 9},
+	}
+
+	// a bare SealVerifyInfo parses without a seed epoch
+	bare, err := json.Marshal(svi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var proof C2Proof
+	if err := json.Unmarshal(bare, &proof); err != nil {
+		t.Fatal(err)
+	}
+	if proof.SeedEpoch != 0 || proof.SectorID != svi.SectorID || !bytes.Equal(proof.Proof, svi.Proof) {
+		t.Errorf("bare SealVerifyInfo parsed as %+v", proof)
+	}
+
+	// the c2 output still parses as a bare SealVerifyInfo
+	out, err := json.Marshal(C2Proof{SealVerifyInfo: svi, SeedEpoch: 101})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed prooftypes.SealVerifyInfo
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.SectorID != svi.SectorID || !bytes.Equal(parsed.InteractiveRandomness, svi.InteractiveRandomness) {
+		t.Errorf("c2 output parsed as %+v", parsed)
+	}
+	proof = C2Proof{}
+	if err := json.Unmarshal(out, &proof); err != nil {
+		t.Fatal(err)
+	}
+	if proof.SeedEpoch != 101 {
+		t.Errorf("seed epoch %d, want 101", proof.SeedEpoch)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("s3cret", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for _, tc := range []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/verify", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%q: got %d, want %d", tc.header, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:9200": true,
+		"localhost:9200": true,
+		"[::1]:9200":     true,
+		":9200":          false,
+		"0.0.0.0:9200":   false,
+		"10.0.0.5:9200":  false,
+		"9200":           false,
+	} {
+		if got := loopbackAddr(addr); got != want {
+			t.Errorf("%s: got %t, want %t", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+// Package ubibenchmark holds files shipped inside the ubi-bench binary.
+package ubibenchmark
+
+import _ "embed"
+
+// ConfigTemplate is the commented config.toml written by `ubi-bench config init`.
+//
+//go:embed config.toml
+var ConfigTemplate string
@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	StoreMcs   = "mcs"
+	StoreTitan = "titan"
+	StoreLocal = "local"
+	StoreS3    = "s3"
+)
+
+// ArtifactStore is a backend the daemon publishes Commit1 outputs to. Keys are
+// slash separated object paths, e.g. "fil-c2/512M/<task-dir>/<file-name>".
+type ArtifactStore interface {
+	Name() string
+	Put(ctx context.Context, key, filePath string) error
+	URL(ctx context.Context, key string) (string, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]string, error)
+	Exists(ctx context.Context, key string) (bool, error)
+}
+
+// NewArtifactStores creates the stores enabled in the [STORAGE] section, in the configured order.
+func NewArtifactStores() ([]ArtifactStore, error) {
+	var stores []ArtifactStore
+	for _, name := range GetConfig().StorageBackends() {
+		store, err := NewArtifactStore(name)
+		if err != nil {
+			return nil, xerrors.Errorf("creating %s store: %w", name, err)
+		}
+		stores = append(stores, store)
+	}
+	return stores, nil
+}
+
+func NewArtifactStore(name string) (ArtifactStore, error) {
+	switch name {
+	case StoreMcs:
+		return NewMcsStore()
+	case StoreTitan:
+		return NewTitanStore(GetConfig().HUB.TITAN_KEY, map[string]int{
+			"fil-c2/512M": GetConfig().HUB.TITAN_FOLDER_512,
+			"fil-c2/32G":  GetConfig().HUB.TITAN_FOLDER_32,
+		})
+	case StoreLocal:
+		return NewLocalStore(GetConfig().LOCAL.Dir, GetConfig().LOCAL.BaseUrl)
+	case StoreS3:
+		return NewS3Store(GetConfig().S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", name)
+	}
+}
+
+type McsStore struct {
+	service *StorageService
+
+	lk      sync.Mutex
+	folders map[string]struct{}
+}
+
+func NewMcsStore() (*McsStore, error) {
+	service := NewStorageService()
+	if service.mcsClient == nil {
+		return nil, xerrors.Errorf("mcs client is not logged in")
+	}
+	return &McsStore{
+		service: service,
+		folders: make(map[string]struct{}),
+	}, nil
+}
+
+func (s *McsStore) Name() string {
+	return StoreMcs
+}
+
+func (s *McsStore) Put(ctx context.Context, key, filePath string) error {
+	folder := path.Dir(key)
+	s.lk.Lock()
+	if _, ok := s.folders[folder]; !ok && strings.Contains(folder, "/") {
+		err := s.service.CreateFolder(path.Dir(folder), path.Base(folder))
+		if err != nil && !strings.Contains(strings.ToLower(err.Error()), "exist") {
+			s.lk.Unlock()
+			return xerrors.Errorf("creating mcs folder %s: %w", folder, err)
+		}
+		s.folders[folder] = struct{}{}
+	}
+	s.lk.Unlock()
+
+	_, err := s.service.UploadFileToBucket(key, filePath, true)
+	return err
+}
+
+func (s *McsStore) URL(ctx context.Context, key string) (string, error) {
+	file, err := s.service.GetFile(key)
+	if err != nil {
+		return "", err
+	}
+	if file == nil || file.PayloadCid == "" {
+		return "", xerrors.Errorf("file %s has no payload cid yet", key)
+	}
+
+	gatewayUrl, err := s.service.GetGatewayUrl()
+	if err != nil {
+		return "", xerrors.Errorf("getting mcs ipfs gateway: %w", err)
+	}
+	return *gatewayUrl + "/ipfs/" + file.PayloadCid, nil
+}
+
+func (s *McsStore) Delete(ctx context.Context, key string) error {
+	return s.service.DeleteFile(key)
+}
+
+func (s *McsStore) List(ctx context.Context, prefix string) ([]string, error) {
+	return s.service.ListFiles(prefix)
+}
+
+func (s *McsStore) Exists(ctx context.Context, key string) (bool, error) {
+	file, err := s.service.GetFile(key)
+	if err != nil {
+		if strings.Contains(err.Error(), "record not found") {
+			return false, nil
+		}
+		return false, err
+	}
+	return file != nil && !file.IsDeleted, nil
+}
+
+// TitanStore uploads into the Titan folder configured for the key's sector type. Titan has no
+// path based lookup, so URLs of uploaded files are only known to the process that uploaded them.
+type TitanStore struct {
+	client  *TiTanClient
+	folders map[string]int
+
+	lk   sync.Mutex
+	urls map[string]string
+}
+
+func NewTitanStore(apiKey string, folders map[string]int) (*TitanStore, error) {
+	client, err := NewTiTanClient(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	return &TitanStore{
+		client:  client,
+		folders: folders,
+		urls:    make(map[string]string),
+	}, nil
+}
+
+func (s *TitanStore) Name() string {
+	return StoreTitan
+}
+
+func (s *TitanStore) Put(ctx context.Context, key, filePath string) error {
+	folderId, ok := s.folders[path.Dir(path.Dir(key))]
+	if !ok {
+		return xerrors.Errorf("no titan folder configured for %s", key)
+	}
+
+	url, err := s.client.UploadFile(filePath, folderId)
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		return xerrors.Errorf("titan returned no url for %s", key)
+	}
+
+	s.lk.Lock()
+	s.urls[key] = url
+	s.lk.Unlock()
+	return nil
+}
+
+func (s *TitanStore) URL(ctx context.Context, key string) (string, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	url, ok := s.urls[key]
+	if !ok {
+		return "", xerrors.Errorf("file %s was not uploaded to titan", key)
+	}
+	return url, nil
+}
+
+func (s *TitanStore) Delete(ctx context.Context, key string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	delete(s.urls, key)
+	return nil
+}
+
+func (s *TitanStore) List(ctx context.Context, prefix string) ([]string, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	var keys []string
+	for key := range s.urls {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *TitanStore) Exists(ctx context.Context, key string) (bool, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	_, ok := s.urls[key]
+	return ok, nil
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	ChainLotus = "lotus"
+	ChainFake  = "fake"
+)
+
+type CHAIN struct {
+	Follow         string `toml:"FOLLOW"`                  // empty, lotus or fake
+	LotusApi       string `toml:"LOTUS_API" secret:"true"` // FULLNODE_API_INFO, defaults to RANDOMNESS.LOTUS_API
+	Confidence     int64  `toml:"CONFIDENCE"`              // epochs to stay behind the head
+	FakeStart      int64  `toml:"FAKE_START"`              // height of the fake chain when the daemon starts
+	FakeBlockDelay int64  `toml:"FAKE_BLOCK_DELAY"`        // seconds per fake epoch
+}
+
+// ChainHead reports the height of the chain the daemon follows.
+type ChainHead interface {
+	Name() string
+	ChainHeight(ctx context.Context) (int64, error)
+	Close() error
+}
+
+// NewChainHead creates the chain selected by CHAIN.FOLLOW, nil when the daemon does not
+// follow a chain.
+func NewChainHead(ctx context.Context, cfg *Config) (ChainHead, error) {
+	switch cfg.CHAIN.Follow {
+	case "":
+		return nil, nil
+	case ChainLotus:
+		apiInfo := cfg.CHAIN.LotusApi
+		if apiInfo == "" {
+			apiInfo = cfg.RANDOMNESS.LotusApi
+		}
+		if apiInfo == "" {
+			return nil, xerrors.Errorf("following lotus requires CHAIN.LOTUS_API")
+		}
+		node, err := NewNodeService(ctx, apiInfo)
+		if err != nil {
+			return nil, xerrors.Errorf("connecting to lotus: %w", err)
+		}
+		return node, nil
+	case ChainFake:
+		delay := cfg.CHAIN.FakeBlockDelay
+		if delay == 0 {
+			delay = filecoinBlockDelay
+		}
+		return NewFakeChain(cfg.CHAIN.FakeStart, time.Duration(delay)*time.Second), nil
+	default:
+		return nil, xerrors.Errorf("unknown chain %q", cfg.CHAIN.Follow)
+	}
+}
+
+func (s *NodeService) Name() string {
+	return ChainLotus
+}
+
+// ChainHeight returns the height of the node's heaviest tipset.
+func (s *NodeService) ChainHeight(ctx context.Context) (int64, error) {
+	ts, err := s.api.ChainHead(ctx)
+	if err != nil {
+		return 0, xerrors.Errorf("getting chain head: %w", err)
+	}
+	return int64(ts.Height()), nil
+}
+
+// FakeChain is an in-process chain that produces an epoch every block delay. With a delay of
+// zero it only moves when advanced by hand, which tests use; the config always sets a delay.
+type FakeChain struct {
+	start time.Time
+	delay time.Duration
+
+	lk     sync.Mutex
+	height int64
+}
+
+func NewFakeChain(height int64, delay time.Duration) *FakeChain {
+	return &FakeChain{
+		start:  time.Now(),
+		delay:  delay,
+		height: height,
+	}
+}
+
+func (f *FakeChain) Name() string {
+	return ChainFake
+}
+
+func (f *FakeChain) ChainHeight(ctx context.Context) (int64, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	if f.delay <= 0 {
+		return f.height, nil
+	}
+	return f.height + int64(time.Since(f.start)/f.delay), nil
+}
+
+// Advance adds n epochs to the chain.
+func (f *FakeChain) Advance(n int64) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	f.height += n
+}
+
+func (f *FakeChain) Close() error {
+	return nil
+}
+
+func (c CHAIN) validate() []error {
+	var errs []error
+	switch c.Follow {
+	case "", ChainLotus, ChainFake:
+	default:
+		errs = append(errs, fmt.Errorf("CHAIN.FOLLOW must be empty, lotus or fake, got %q", c.Follow))
+	}
+	if c.Confidence < 0 || c.FakeStart < 0 || c.FakeBlockDelay < 0 {
+		errs = append(errs, fmt.Errorf("CHAIN values must not be negative"))
+	}
+	return errs
+}
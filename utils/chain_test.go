@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFakeChainManual(t *testing.T) {
+	ctx := context.Background()
+	chain := NewFakeChain(100, 0)
+	for _, step := range []struct {
+		advance int64
+		want    int64
+	}{
+		{0, 100},
+		{1, 101},
+		{5, 106},
+	} {
+		chain.Advance(step.advance)
+		height, err := chain.ChainHeight(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height != step.want {
+			t.Fatalf("height %d, want %d", height, step.want)
+		}
+	}
+}
+
+func TestFakeChainBlockDelay(t *testing.T) {
+	ctx := context.Background()
+	chain := NewFakeChain(10, time.Hour)
+	chain.start = chain.start.Add(-3*time.Hour - time.Minute)
+	chain.Advance(2)
+	height, err := chain.ChainHeight(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 15 {
+		t.Fatalf("height %d, want 15", height)
+	}
+}
+
+func TestNewChainHeadFake(t *testing.T) {
+	ctx := context.Background()
+	head, err := NewChainHead(ctx, &Config{CHAIN: CHAIN{Follow: ChainFake, FakeStart: 42}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer head.Close()
+	if head.Name() != ChainFake {
+		t.Fatalf("chain %s, want %s", head.Name(), ChainFake)
+	}
+	if height, err := head.ChainHeight(ctx); err != nil || height != 42 {
+		t.Fatalf("height %d (%v), want 42", height, err)
+	}
+
+	head, err = NewChainHead(ctx, &Config{})
+	if err != nil || head != nil {
+		t.Fatalf("no chain to follow, got %v, %v", head, err)
+	}
+}
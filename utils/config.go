@@ -1,21 +1,41 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"time"
 )
 
-var config *Config
+var (
+	config     atomic.Pointer[Config]
+	configPath = "config.toml"
+	requireHub bool
+)
 
 type Config struct {
-	MCS MCS
-	HUB HUB
+	MCS        MCS
+	HUB        HUB
+	STORAGE    STORAGE
+	LOCAL      LOCAL
+	S3         S3
+	PIPELINE   PIPELINE
+	POLICY     POLICY
+	METRICS    METRICS
+	STATUS     STATUS
+	RANDOMNESS RANDOMNESS
+	CHAIN      CHAIN
+	SECRETS    SECRETS
 }
 
 type MCS struct {
-	ApiKey     string
+	ApiKey     string `secret:"true"`
 	BucketName string
 	Network    string
 }
@@ -26,45 +46,323 @@ type HUB struct {
 	CheckInterval    int64  `toml:"CHECK_INTERVAL"`
 	BatchNum         int    `toml:"BATCH_NUM"`
 	ENABLE_TITAN     int    `toml:"ENABLE_TITAN"`
-	TITAN_KEY        string `toml:"TITAN_KEY"`
+	TITAN_KEY        string `toml:"TITAN_KEY" secret:"true"`
 	TITAN_FOLDER_512 int    `toml:"TITAN_FOLDER_512"`
 	TITAN_FOLDER_32  int    `toml:"TITAN_FOLDER_32"`
+	RequestTimeout   int64  `toml:"REQUEST_TIMEOUT"`
+	MaxRetries       int    `toml:"MAX_RETRIES"`
+	RetryBackoff     int64  `toml:"RETRY_BACKOFF"`
+	RetryMaxBackoff  int64  `toml:"RETRY_MAX_BACKOFF"`
+	AuthToken        string `toml:"AUTH_TOKEN" secret:"true"`
+	HmacKeyId        string `toml:"HMAC_KEY_ID"`
+	HmacSecret       string `toml:"HMAC_SECRET" secret:"true"`
+}
+
+type STORAGE struct {
+	Backends []string `toml:"BACKENDS"`
+}
+
+type LOCAL struct {
+	Dir     string `toml:"DIR"`
+	Listen  string `toml:"LISTEN"`
+	BaseUrl string `toml:"BASE_URL"`
+	Source  int    `toml:"SOURCE"`
+}
+
+type S3 struct {
+	Endpoint      string `toml:"ENDPOINT"`
+	Region        string `toml:"REGION"`
+	Bucket        string `toml:"BUCKET"`
+	AccessKey     string `toml:"ACCESS_KEY"`
+	SecretKey     string `toml:"SECRET_KEY" secret:"true"`
+	PathStyle     bool   `toml:"PATH_STYLE"`
+	PublicUrl     string `toml:"PUBLIC_URL"`
+	PresignExpire int64  `toml:"PRESIGN_EXPIRE"`
+	Source        int    `toml:"SOURCE"`
+}
+
+type PIPELINE struct {
+	Commit1Workers  int `toml:"COMMIT1_WORKERS"`
+	CompressWorkers int `toml:"COMPRESS_WORKERS"`
+	UploadWorkers   int `toml:"UPLOAD_WORKERS"`
+	SubmitWorkers   int `toml:"SUBMIT_WORKERS"`
+	QueueDepth      int `toml:"QUEUE_DEPTH"`
+	MaxAttempts     int `toml:"MAX_ATTEMPTS"`
+	RetryBackoff    int `toml:"RETRY_BACKOFF"` // seconds
+}
+
+type METRICS struct {
+	Listen string `toml:"LISTEN"`
+}
+
+type STATUS struct {
+	Listen string `toml:"LISTEN"`
+}
+
+// Replenish controls how the daemon refills the hub queue of a resource. Zero values inherit
+// from the less specific level.
+type Replenish struct {
+	LowWatermark    int `toml:"LOW_WATERMARK"`
+	HighWatermark   int `toml:"HIGH_WATERMARK"`
+	TargetDepth     int `toml:"TARGET_DEPTH"`
+	Copies          int `toml:"COPIES"`
+	MaxTasksPerTick int `toml:"MAX_TASKS_PER_TICK"`
+}
+
+type POLICY struct {
+	Replenish
+	Rules []PolicyRule `toml:"RULES"`
+}
+
+// PolicyRule overrides the replenish settings for a task source, a resource id or both.
+type PolicyRule struct {
+	Source     *int `toml:"SOURCE"`
+	ResourceId int  `toml:"RESOURCE_ID"`
+	Replenish
+}
+
+// StorageBackends returns the artifact stores the daemon should publish to. Configs without a
+// [STORAGE] section keep the old behaviour: MCS, plus Titan when ENABLE_TITAN is set.
+func (c *Config) StorageBackends() []string {
+	if len(c.STORAGE.Backends) > 0 {
+		return c.STORAGE.Backends
+	}
+	backends := []string{StoreMcs}
+	if c.HUB.ENABLE_TITAN == 1 {
+		backends = append(backends, StoreTitan)
+	}
+	return backends
+}
+
+// StoreSource returns the hub task source the tasks of backend are reported under.
+func (c *Config) StoreSource(backend string) int {
+	switch backend {
+	case StoreTitan:
+		return 1
+	case StoreLocal:
+		return c.LOCAL.Source
+	case StoreS3:
+		return c.S3.Source
+	}
+	return 0
+}
+
+// SetConfigPath sets the file InitConfig and ReloadConfig read, config.toml in the working
+// directory by default.
+func SetConfigPath(path string) {
+	configPath = path
+}
+
+// ConfigPath returns the absolute path of the config file.
+func ConfigPath() (string, error) {
+	return filepath.Abs(configPath)
+}
+
+// RequireHub makes InitConfig and ReloadConfig also check the [HUB] urls, for the commands that
+// talk to the hub. Other commands run with the urls of the template left unset.
+func RequireHub() {
+	requireHub = true
 }
 
 func InitConfig() error {
-	dir, err := os.Getwd()
+	_, err := ReloadConfig()
+	return err
+}
+
+// ReloadConfig reads the config file again, applies the UBI_* environment overrides and resolves
+// secret references. The current config is only replaced when the result is valid, so a broken
+// edit leaves a running daemon on its previous settings.
+func ReloadConfig() (*Config, error) {
+	configFile, err := ConfigPath()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	configFile := filepath.Join(dir, "config.toml")
 
-	if metaData, err := toml.DecodeFile(configFile, &config); err != nil {
-		return fmt.Errorf("failed load config file, path: %s, error: %w", configFile, err)
-	} else {
-		if !requiredFieldsAreGiven(metaData) {
-			log.Fatal("Required fields not given")
-		}
+	cfg := new(Config)
+	metaData, err := toml.DecodeFile(configFile, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed load config file, path: %s, error: %w", configFile, err)
+	}
+	for _, key := range metaData.Undecoded() {
+		log.Warnf("config: unknown key %s in %s", key, configFile)
 	}
-	return nil
+	if err := applyEnvOverrides(cfg); err != nil {
+		return nil, err
+	}
+	InstallLogRedaction()
+	if err := resolveSecrets(cfg); err != nil {
+		return nil, fmt.Errorf("resolving secrets of %s: %w", configFile, err)
+	}
+	err = cfg.Validate()
+	if requireHub {
+		err = errors.Join(err, cfg.ValidateHub())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", configFile, err)
+	}
+	config.Store(cfg)
+	return cfg, nil
 }
 
 func GetConfig() *Config {
-	return config
+	return config.Load()
 }
 
-func requiredFieldsAreGiven(metaData toml.MetaData) bool {
-	requiredFields := [][]string{
-		{"MCS"},
-		{"MCS", "ApiKey"},
-		{"MCS", "BucketName"},
-		{"MCS", "Network"},
+// Validate checks every section the configured backends depend on and returns all problems
+// at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
 	}
 
-	for _, v := range requiredFields {
-		if !metaData.IsDefined(v...) {
-			log.Fatal("Required fields ", v)
+	check(c.HUB.CheckInterval > 0, "HUB.CHECK_INTERVAL must be positive")
+	check(c.HUB.BatchNum > 0, "HUB.BATCH_NUM must be positive")
+	check(c.HUB.ENABLE_TITAN == 0 || c.HUB.ENABLE_TITAN == 1, "HUB.ENABLE_TITAN must be 0 or 1")
+	check(c.HUB.RequestTimeout >= 0, "HUB.REQUEST_TIMEOUT must not be negative")
+	check(c.HUB.MaxRetries >= 0, "HUB.MAX_RETRIES must not be negative")
+	check(c.HUB.RetryBackoff >= 0, "HUB.RETRY_BACKOFF must not be negative")
+	check(c.HUB.RetryMaxBackoff >= 0, "HUB.RETRY_MAX_BACKOFF must not be negative")
+	check(c.HUB.HmacKeyId == "" || c.HUB.HmacSecret != "", "HUB.HMAC_KEY_ID is set without HUB.HMAC_SECRET")
+
+	titan := c.HUB.ENABLE_TITAN == 1
+	sources := make(map[int]string)
+	for _, backend := range c.StorageBackends() {
+		// two backends on one source would fill the same hub queue and both count its shortfall
+		if other, ok := sources[c.StoreSource(backend)]; ok {
+			check(false, "STORAGE.BACKENDS: %s and %s both report hub source %d, set distinct LOCAL.SOURCE and S3.SOURCE ids",
+				other, backend, c.StoreSource(backend))
+		} else {
+			sources[c.StoreSource(backend)] = backend
+		}
+		switch backend {
+		case StoreMcs:
+			check(c.MCS.ApiKey != "", "MCS.ApiKey is required by the mcs backend")
+			check(c.MCS.BucketName != "", "MCS.BucketName is required by the mcs backend")
+			check(c.MCS.Network != "", "MCS.Network is required by the mcs backend")
+		case StoreTitan:
+			titan = true
+		case StoreLocal:
+			check(c.LOCAL.Dir != "", "LOCAL.DIR is required by the local backend")
+			check(c.LOCAL.BaseUrl == "" || validUrl(c.LOCAL.BaseUrl), "LOCAL.BASE_URL must be an http(s) url, got %q", c.LOCAL.BaseUrl)
+		case StoreS3:
+			check(validUrl(c.S3.Endpoint), "S3.ENDPOINT must be an http(s) url, got %q", c.S3.Endpoint)
+			check(c.S3.Bucket != "", "S3.BUCKET is required by the s3 backend")
+			check(c.S3.AccessKey != "", "S3.ACCESS_KEY is required by the s3 backend")
+			check(c.S3.SecretKey != "", "S3.SECRET_KEY is required by the s3 backend")
+			check(c.S3.PublicUrl == "" || validUrl(c.S3.PublicUrl), "S3.PUBLIC_URL must be an http(s) url, got %q", c.S3.PublicUrl)
+			check(c.S3.PresignExpire >= 0 && c.S3.PresignExpire <= 604800, "S3.PRESIGN_EXPIRE must be between 0 and 604800 seconds")
+		default:
+			check(false, "STORAGE.BACKENDS: unknown backend %q", backend)
 		}
 	}
+	if titan {
+		check(c.HUB.TITAN_KEY != "", "HUB.TITAN_KEY is required when titan is enabled")
+		check(c.HUB.TITAN_FOLDER_512 > 0, "HUB.TITAN_FOLDER_512 is required when titan is enabled")
+		check(c.HUB.TITAN_FOLDER_32 > 0, "HUB.TITAN_FOLDER_32 is required when titan is enabled")
+	}
+
+	check(c.PIPELINE.Commit1Workers >= 0 && c.PIPELINE.CompressWorkers >= 0 && c.PIPELINE.UploadWorkers >= 0 &&
+		c.PIPELINE.SubmitWorkers >= 0 && c.PIPELINE.QueueDepth >= 0 && c.PIPELINE.MaxAttempts >= 0 &&
+		c.PIPELINE.RetryBackoff >= 0, "PIPELINE values must not be negative")
 
-	return true
+	errs = append(errs, c.RANDOMNESS.validate()...)
+	errs = append(errs, c.CHAIN.validate()...)
+	check(c.CHAIN.Follow != ChainLotus || c.CHAIN.LotusApi != "" || c.RANDOMNESS.LotusApi != "",
+		"CHAIN.LOTUS_API or RANDOMNESS.LOTUS_API is required to follow lotus")
+	errs = append(errs, c.POLICY.Replenish.validate("POLICY")...)
+	for i, rule := range c.POLICY.Rules {
+		name := fmt.Sprintf("POLICY.RULES[%d]", i)
+		check(rule.Source != nil || rule.ResourceId != 0, "%s must set SOURCE or RESOURCE_ID", name)
+		check(rule.ResourceId >= 0 && rule.ResourceId <= 4, "%s.RESOURCE_ID must be between 1 and 4", name)
+		errs = append(errs, rule.Replenish.validate(name)...)
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateHub checks the [HUB] urls, which the config template leaves for the operator to fill in.
+func (c *Config) ValidateHub() error {
+	var errs []error
+	for _, u := range []struct{ key, value string }{{"HUB_URL", c.HUB.HubUrl}, {"TASK_URL", c.HUB.TaskUrl}} {
+		if !validUrl(u.value) {
+			errs = append(errs, fmt.Errorf("HUB.%s must be the http(s) url of the hub, got %q: set it in the config file or with UBI_HUB_%s",
+				u.key, u.value, u.key))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r Replenish) validate(section string) []error {
+	var errs []error
+	if r.LowWatermark < 0 || r.HighWatermark < 0 || r.TargetDepth < 0 || r.Copies < 0 || r.MaxTasksPerTick < 0 {
+		errs = append(errs, fmt.Errorf("%s values must not be negative", section))
+	}
+	if r.LowWatermark > 0 && r.HighWatermark > 0 && r.HighWatermark < r.LowWatermark {
+		errs = append(errs, fmt.Errorf("%s.HIGH_WATERMARK must not be below LOW_WATERMARK", section))
+	}
+	return errs
+}
+
+const redacted = "<redacted>"
+
+// Redacted returns a copy of the config with every field tagged secret:"true" that is set
+// replaced by a placeholder, for printing.
+func (c *Config) Redacted() Config {
+	out := *c
+	redact(reflect.ValueOf(&out).Elem())
+	return out
+}
+
+func redact(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			redact(v.Field(i))
+		case f.Tag.Get("secret") == "true" && f.Type.Kind() == reflect.String && v.Field(i).String() != "":
+			v.Field(i).SetString(redacted)
+		}
+	}
+}
+
+func validUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// WatchConfig polls the config file every interval until ctx is done and calls onChange after
+// the file was modified.
+func WatchConfig(ctx context.Context, interval time.Duration, onChange func()) {
+	path, err := ConfigPath()
+	if err != nil {
+		log.Errorf("config watcher: %v", err)
+		return
+	}
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+
+	modTime, size := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t, n := stat()
+			if n < 0 || (t.Equal(modTime) && n == size) {
+				continue
+			}
+			modTime, size = t, n
+			onChange()
+		}
+	}
 }
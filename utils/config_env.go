@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const envPrefix = "UBI_"
+
+// applyEnvOverrides sets every config field that has an environment variable named
+// UBI_<SECTION>_<KEY>, e.g. UBI_HUB_TASK_URL or UBI_MCS_API_KEY. KEY is the field's toml key,
+// or its name in upper snake case for keys without one. Lists take comma separated values;
+// POLICY.RULES can only be set in the file.
+func applyEnvOverrides(cfg *Config) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if err := applyEnvSection(envPrefix+t.Field(i).Name+"_", v.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyEnvSection(prefix string, section reflect.Value) error {
+	var err error
+	forEachEnvField(prefix, section, func(name string, field reflect.Value) {
+		value, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if serr := setEnvValue(field, value); serr != nil {
+			err = fmt.Errorf("environment variable %s: %w", name, serr)
+		}
+	})
+	return err
+}
+
+func forEachEnvField(prefix string, section reflect.Value, fn func(name string, field reflect.Value)) {
+	t := section.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			forEachEnvField(prefix, section.Field(i), fn)
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int64:
+		case reflect.Slice:
+			if f.Type.Elem().Kind() != reflect.String {
+				continue
+			}
+		default:
+			continue
+		}
+		key := f.Tag.Get("toml")
+		if key == "" {
+			key = upperSnake(f.Name)
+		}
+		fn(prefix+key, section.Field(i))
+	}
+}
+
+func setEnvValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
+
+// upperSnake turns ApiKey into API_KEY.
+func upperSnake(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(rune(name[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
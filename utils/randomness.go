@@ -0,0 +1,306 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/build/buildconstants"
+	"github.com/filecoin-project/lotus/chain/beacon"
+	lrand "github.com/filecoin-project/lotus/chain/rand"
+	"github.com/filecoin-project/lotus/chain/types"
+	"golang.org/x/xerrors"
+)
+
+const (
+	RandomnessMock  = "mock"
+	RandomnessLotus = "lotus"
+	RandomnessDrand = "drand"
+
+	// mainnet values, used when [RANDOMNESS] leaves them unset
+	filecoinGenesisTime = 1598306400
+	filecoinBlockDelay  = 30
+)
+
+type RANDOMNESS struct {
+	Source       string `toml:"SOURCE"`                  // mock, lotus or drand
+	LotusApi     string `toml:"LOTUS_API" secret:"true"` // FULLNODE_API_INFO of the node, token:multiaddr
+	DrandNetwork string `toml:"DRAND_NETWORK"`           // quicknet or mainnet
+	GenesisTime  int64  `toml:"GENESIS_TIME"`            // unix time of the Filecoin genesis the epochs are mapped from
+	BlockDelay   int64  `toml:"BLOCK_DELAY"`             // seconds per epoch
+}
+
+// RandomnessSource returns the interactive seal randomness of a miner at a height. Seeds of
+// the same source, miner and height are always equal, so generator and verifier must use the
+// same source.
+type RandomnessSource interface {
+	Name() string
+	GetRandomness(ctx context.Context, minerId address.Address, tag crypto.DomainSeparationTag, height int64) ([]byte, error)
+	Close() error
+}
+
+// NewRandomnessSource creates the source selected by cfg.Source, the mock beacon when it is empty.
+func NewRandomnessSource(ctx context.Context, cfg RANDOMNESS) (RandomnessSource, error) {
+	switch cfg.Source {
+	case "", RandomnessMock:
+		return NewMockRandomness(), nil
+	case RandomnessLotus:
+		if cfg.LotusApi == "" {
+			return nil, xerrors.Errorf("lotus randomness requires RANDOMNESS.LOTUS_API")
+		}
+		node, err := NewNodeService(ctx, cfg.LotusApi)
+		if err != nil {
+			return nil, xerrors.Errorf("connecting to lotus: %w", err)
+		}
+		return &LotusRandomness{node: node}, nil
+	case RandomnessDrand:
+		return NewDrandRandomness(cfg)
+	default:
+		return nil, xerrors.Errorf("unknown randomness source %q", cfg.Source)
+	}
+}
+
+var mockBeacon = beacon.NewMockBeacon(time.Second)
+
+// MockRandomness returns the seeds of GetRandomness, derived from lotus' mock beacon. It needs
+// no network, but anyone can compute the seed of any height in advance.
+type MockRandomness struct{}
+
+func NewMockRandomness() *MockRandomness {
+	return &MockRandomness{}
+}
+
+func (r *MockRandomness) Name() string {
+	return RandomnessMock
+}
+
+func (r *MockRandomness) GetRandomness(ctx context.Context, minerId address.Address, tag crypto.DomainSeparationTag, height int64) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return GetRandomness(minerId, tag, height)
+}
+
+func (r *MockRandomness) Close() error {
+	return nil
+}
+
+// LotusRandomness asks a Lotus full node for the beacon randomness of the chain. Heights ahead
+// of the node's head are refused.
+type LotusRandomness struct {
+	node *NodeService
+}
+
+func (r *LotusRandomness) Name() string {
+	return RandomnessLotus
+}
+
+func (r *LotusRandomness) GetRandomness(ctx context.Context, minerId address.Address, tag crypto.DomainSeparationTag, height int64) ([]byte, error) {
+	entropy, err := minerEntropy(minerId)
+	if err != nil {
+		return nil, err
+	}
+	rand, err := r.node.FullNodeAPI().StateGetRandomnessFromBeacon(ctx, tag, abi.ChainEpoch(height), entropy, types.EmptyTSK)
+	if err != nil {
+		return nil, xerrors.Errorf("getting beacon randomness of height %d from lotus: %w", height, err)
+	}
+	return rand, nil
+}
+
+func (r *LotusRandomness) Close() error {
+	return r.node.Close()
+}
+
+// DrandRandomness fetches the drand round of a height from the drand HTTP API, mapping heights
+// to rounds the way a Filecoin node does. Responses are checked against the round and the
+// randomness they claim, but their BLS signatures are not verified; use the lotus source when
+// seeds must be verified against the chain.
+type DrandRandomness struct {
+	servers     []string
+	info        drandChainInfo
+	genesisTime int64
+	blockDelay  int64
+	client      *http.Client
+}
+
+type drandChainInfo struct {
+	Period      int64  `json:"period"`
+	GenesisTime int64  `json:"genesis_time"`
+	Hash        string `json:"hash"`
+}
+
+type drandRound struct {
+	Round      uint64 `json:"round"`
+	Randomness string `json:"randomness"`
+	Signature  string `json:"signature"`
+}
+
+func NewDrandRandomness(cfg RANDOMNESS) (*DrandRandomness, error) {
+	var network buildconstants.DrandEnum
+	switch cfg.DrandNetwork {
+	case "", "quicknet":
+		network = buildconstants.DrandQuicknet
+	case "mainnet":
+		network = buildconstants.DrandMainnet
+	default:
+		return nil, xerrors.Errorf("unknown drand network %q", cfg.DrandNetwork)
+	}
+	if cfg.GenesisTime < 0 || cfg.BlockDelay < 0 {
+		return nil, xerrors.Errorf("drand genesis time and block delay must not be negative")
+	}
+	dc := buildconstants.DrandConfigs[network]
+
+	r := &DrandRandomness{
+		servers:     dc.Servers,
+		genesisTime: cfg.GenesisTime,
+		blockDelay:  cfg.BlockDelay,
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+	if err := json.Unmarshal([]byte(dc.ChainInfoJSON), &r.info); err != nil {
+		return nil, xerrors.Errorf("parsing drand chain info: %w", err)
+	}
+	if r.genesisTime == 0 {
+		r.genesisTime = filecoinGenesisTime
+	}
+	if r.blockDelay == 0 {
+		r.blockDelay = filecoinBlockDelay
+	}
+	return r, nil
+}
+
+func (r *DrandRandomness) Name() string {
+	return RandomnessDrand
+}
+
+func (r *DrandRandomness) GetRandomness(ctx context.Context, minerId address.Address, tag crypto.DomainSeparationTag, height int64) ([]byte, error) {
+	round := r.round(height)
+	var errs []error
+	for _, server := range r.servers {
+		sig, err := r.fetch(ctx, server, round)
+		if err == nil {
+			return drawRandomness(sig, minerId, tag, height)
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, xerrors.Errorf("fetching drand round %d of height %d: %w", round, height, errors.Join(errs...))
+}
+
+// round returns the latest drand round published before height started, as
+// DrandBeacon.MaxBeaconRoundForEpoch does since network version 16.
+func (r *DrandRandomness) round(height int64) uint64 {
+	latest := height*r.blockDelay + r.genesisTime - r.blockDelay
+	if latest < r.info.GenesisTime {
+		return 1
+	}
+	return uint64((latest-r.info.GenesisTime)/r.info.Period) + 1
+}
+
+func (r *DrandRandomness) fetch(ctx context.Context, server string, round uint64) ([]byte, error) {
+	url := fmt.Sprintf("%s/%s/public/%d", strings.TrimRight(server, "/"), r.info.Hash, round)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("%s: status code: %d", server, resp.StatusCode)
+	}
+
+	var out drandRound
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, xerrors.Errorf("%s: %w", server, err)
+	}
+	sig, err := hex.DecodeString(out.Signature)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: decoding signature: %w", server, err)
+	}
+	digest := sha256.Sum256(sig)
+	if out.Round != round || out.Randomness != hex.EncodeToString(digest[:]) {
+		return nil, xerrors.Errorf("%s: inconsistent response for round %d", server, round)
+	}
+	return sig, nil
+}
+
+func (r *DrandRandomness) Close() error {
+	return nil
+}
+
+// beaconRandomness draws the randomness of height from the latest beacon entry of its epoch.
+func beaconRandomness(ctx context.Context, b beacon.RandomBeacon, minerId address.Address, tag crypto.DomainSeparationTag, height int64) ([]byte, error) {
+	epoch := abi.ChainEpoch(height)
+	round := b.MaxBeaconRoundForEpoch(network.Version16, epoch)
+
+	start := build.Clock.Now()
+	var rbase types.BeaconEntry
+	select {
+	case resp := <-b.Entry(ctx, round):
+		if resp.Err != nil {
+			return nil, xerrors.Errorf("beacon entry request returned error: %w", resp.Err)
+		}
+		rbase = resp.Entry
+	case <-ctx.Done():
+		return nil, xerrors.Errorf("context timed out waiting on beacon entry to come back for epoch %d: %w", epoch, ctx.Err())
+	}
+	log.Debugw("fetched beacon entry", "took", build.Clock.Since(start), "round", round)
+	return drawRandomness(rbase.Data, minerId, tag, height)
+}
+
+// drawRandomness derives the randomness of height from the data of a beacon entry.
+func drawRandomness(entry []byte, minerId address.Address, tag crypto.DomainSeparationTag, height int64) ([]byte, error) {
+	entropy, err := minerEntropy(minerId)
+	if err != nil {
+		return nil, err
+	}
+	rand, err := lrand.DrawRandomnessFromBase(entry, tag, abi.ChainEpoch(height), entropy)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get randomness for computing seal proof: %w", err)
+	}
+	return rand, nil
+}
+
+func minerEntropy(minerId address.Address) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := minerId.MarshalCBOR(buf); err != nil {
+		return nil, xerrors.Errorf("failed to marshal miner address: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c RANDOMNESS) validate() []error {
+	var errs []error
+	switch c.Source {
+	case "", RandomnessMock, RandomnessDrand:
+	case RandomnessLotus:
+		if c.LotusApi == "" {
+			errs = append(errs, fmt.Errorf("RANDOMNESS.LOTUS_API is required by the lotus source"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("RANDOMNESS.SOURCE must be mock, lotus or drand, got %q", c.Source))
+	}
+	if c.DrandNetwork != "" && c.DrandNetwork != "quicknet" && c.DrandNetwork != "mainnet" {
+		errs = append(errs, fmt.Errorf("RANDOMNESS.DRAND_NETWORK must be quicknet or mainnet, got %q", c.DrandNetwork))
+	}
+	if c.GenesisTime < 0 || c.BlockDelay < 0 {
+		errs = append(errs, fmt.Errorf("RANDOMNESS values must not be negative"))
+	}
+	return errs
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/crypto"
+)
+
+// The seed of miner t01000 at height 100 as the mock beacon derived it before the randomness
+// sources were added, generated tasks and their verification depend on it staying the same.
+const mockSeed = "5708630797b385e8efeb9ce9b9d00507bab2b1051b234a62e28d6bb436d61aa3"
+
+func TestMockRandomnessSeed(t *testing.T) {
+	miner, err := address.NewIDAddress(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := GetRandomness(miner, crypto.DomainSeparationTag_InteractiveSealChallengeSeed, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(seed); got != mockSeed {
+		t.Fatalf("GetRandomness: %s, want %s", got, mockSeed)
+	}
+
+	seed, err = NewMockRandomness().GetRandomness(context.Background(), miner, crypto.DomainSeparationTag_InteractiveSealChallengeSeed, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(seed); got != mockSeed {
+		t.Fatalf("mock source: %s, want %s", got, mockSeed)
+	}
+}
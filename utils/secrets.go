@@ -0,0 +1,367 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/filswan/go-mcs-sdk/mcs/api/common/logs"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Fields tagged secret:"true" may hold a reference instead of the secret itself:
+//
+//	env:NAME            the value of the environment variable NAME
+//	file:/path          the trimmed content of a file, e.g. a docker or kubernetes secret
+//	keystore:NAME       the entry NAME of the encrypted keystore given by [SECRETS] KEYSTORE
+const (
+	secretEnvPrefix      = "env:"
+	secretFilePrefix     = "file:"
+	secretKeystorePrefix = "keystore:"
+
+	// KeystorePassphraseEnv holds the keystore passphrase when [SECRETS] PASSPHRASE_FILE is unset.
+	KeystorePassphraseEnv = "UBI_KEYSTORE_PASSPHRASE"
+
+	keystoreVersion = 1
+)
+
+type SECRETS struct {
+	Keystore       string `toml:"KEYSTORE"`
+	PassphraseFile string `toml:"PASSPHRASE_FILE"`
+}
+
+// resolveSecrets replaces every secret reference in cfg by the secret and registers the
+// secrets with the log redactor.
+func resolveSecrets(cfg *Config) error {
+	var entries map[string]string
+	var err error
+	walkSecrets(reflect.ValueOf(cfg).Elem(), "", func(name string, field reflect.Value) {
+		if err != nil {
+			return
+		}
+		ref := field.String()
+		var value string
+		switch {
+		case strings.HasPrefix(ref, secretEnvPrefix):
+			env := strings.TrimPrefix(ref, secretEnvPrefix)
+			value = os.Getenv(env)
+			if value == "" {
+				err = fmt.Errorf("%s: environment variable %s is empty", name, env)
+			}
+		case strings.HasPrefix(ref, secretFilePrefix):
+			var data []byte
+			data, err = os.ReadFile(strings.TrimPrefix(ref, secretFilePrefix))
+			if err != nil {
+				err = fmt.Errorf("%s: %w", name, err)
+			}
+			value = strings.TrimSpace(string(data))
+		case strings.HasPrefix(ref, secretKeystorePrefix):
+			if entries == nil {
+				entries, err = openConfigKeystore(cfg.SECRETS)
+				if err != nil {
+					err = fmt.Errorf("%s: %w", name, err)
+					return
+				}
+			}
+			entry := strings.TrimPrefix(ref, secretKeystorePrefix)
+			var ok bool
+			if value, ok = entries[entry]; !ok {
+				err = fmt.Errorf("%s: keystore has no entry %q", name, entry)
+			}
+		default:
+			value = ref
+		}
+		if err != nil {
+			return
+		}
+		field.SetString(value)
+		RegisterSecret(value)
+	})
+	return err
+}
+
+func walkSecrets(v reflect.Value, path string, fn func(name string, field reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if path != "" {
+			name = path + "." + name
+		}
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			walkSecrets(v.Field(i), name, fn)
+		case f.Tag.Get("secret") == "true" && f.Type.Kind() == reflect.String && v.Field(i).String() != "":
+			fn(name, v.Field(i))
+		}
+	}
+}
+
+func openConfigKeystore(cfg SECRETS) (map[string]string, error) {
+	if cfg.Keystore == "" {
+		return nil, fmt.Errorf("keystore reference without [SECRETS] KEYSTORE")
+	}
+	passphrase, err := KeystorePassphrase(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return OpenKeystore(cfg.Keystore, passphrase)
+}
+
+// KeystorePassphrase returns the passphrase from [SECRETS] PASSPHRASE_FILE or the
+// UBI_KEYSTORE_PASSPHRASE environment variable.
+func KeystorePassphrase(cfg SECRETS) (string, error) {
+	if cfg.PassphraseFile != "" {
+		data, err := os.ReadFile(cfg.PassphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("reading keystore passphrase: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if passphrase := os.Getenv(KeystorePassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	return "", fmt.Errorf("keystore passphrase not given, set %s or [SECRETS] PASSPHRASE_FILE", KeystorePassphraseEnv)
+}
+
+type keystoreFile struct {
+	Version    int
+	Salt       []byte
+	N, R, P    int
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// OpenKeystore decrypts the keystore at path. A missing keystore is returned empty.
+func OpenKeystore(path, passphrase string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading keystore: %w", err)
+	}
+	var ks keystoreFile
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return nil, fmt.Errorf("parsing keystore %s: %w", path, err)
+	}
+	if ks.Version != keystoreVersion {
+		return nil, fmt.Errorf("unsupported keystore version %d", ks.Version)
+	}
+
+	aead, err := keystoreCipher(passphrase, ks.Salt, ks.N, ks.R, ks.P)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, ks.Nonce, ks.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting keystore %s: wrong passphrase or corrupted file", path)
+	}
+	entries := make(map[string]string)
+	if err := json.Unmarshal(plain, &entries); err != nil {
+		return nil, fmt.Errorf("parsing keystore entries: %w", err)
+	}
+	return entries, nil
+}
+
+// SaveKeystore encrypts entries with passphrase and writes them to path, readable by the
+// owner only.
+func SaveKeystore(path, passphrase string, entries map[string]string) error {
+	plain, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	ks := keystoreFile{
+		Version: keystoreVersion,
+		Salt:    make([]byte, 32),
+		N:       1 << 15,
+		R:       8,
+		P:       1,
+	}
+	if _, err := rand.Read(ks.Salt); err != nil {
+		return err
+	}
+	aead, err := keystoreCipher(passphrase, ks.Salt, ks.N, ks.R, ks.P)
+	if err != nil {
+		return err
+	}
+	ks.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(ks.Nonce); err != nil {
+		return err
+	}
+	ks.Ciphertext = aead.Seal(nil, ks.Nonce, plain, nil)
+
+	data, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("writing keystore: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func keystoreCipher(passphrase string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+	if err != nil {
+		return nil, fmt.Errorf("deriving keystore key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var (
+	secretsLk sync.RWMutex
+	secrets   []string
+
+	// tokens the MCS SDK prints on failed requests
+	tokenPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), // JWT
+		regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`),
+		// signatures and tokens in the query of presigned urls
+		regexp.MustCompile(`(?i)([?&](?:x-amz-signature|x-amz-credential|x-amz-security-token|signature|token)=)[^&\s"']+`),
+	}
+
+	redactHookOnce sync.Once
+)
+
+// RegisterSecret makes Redact hide value. Values shorter than 4 characters are ignored.
+func RegisterSecret(value string) {
+	if len(value) < 4 {
+		return
+	}
+	secretsLk.Lock()
+	defer secretsLk.Unlock()
+	for _, s := range secrets {
+		if s == value {
+			return
+		}
+	}
+	secrets = append(secrets, value)
+	// replace longer secrets first, a short one may be part of a longer one
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+}
+
+// Redact hides the registered secrets and bearer tokens in s.
+func Redact(s string) string {
+	secretsLk.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	secretsLk.RUnlock()
+	s = tokenPatterns[0].ReplaceAllString(s, redacted)
+	s = tokenPatterns[1].ReplaceAllString(s, "${1}"+redacted)
+	return tokenPatterns[2].ReplaceAllString(s, "${1}"+redacted)
+}
+
+// InstallLogRedaction makes the go-log loggers and the MCS SDK logger redact secrets and
+// tokens before an entry is written to the console or a log file.
+func InstallLogRedaction() {
+	redactHookOnce.Do(func() {
+		installGoLogRedaction()
+
+		logger := logs.GetLogger()
+		old := logger.ReplaceHooks(make(logrus.LevelHooks))
+		hooks := make(logrus.LevelHooks)
+		hooks.Add(redactHook{})
+		for level, levelHooks := range old {
+			hooks[level] = append(hooks[level], levelHooks...)
+		}
+		logger.ReplaceHooks(hooks)
+	})
+}
+
+// redactHook must run before the SDK's file hook, InstallLogRedaction puts it first.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case string:
+			entry.Data[k] = Redact(v)
+		case error:
+			entry.Data[k] = Redact(v.Error())
+		}
+	}
+	return nil
+}
+
+// installGoLogRedaction replaces the go-log primary core with one that writes the same outputs
+// in the same format, but through Redact. Redacting the encoded entry also covers fields and
+// the error chains printed with %+v.
+func installGoLogRedaction() {
+	cfg := logging.GetConfig()
+	var outputs []string
+	if cfg.Stderr {
+		outputs = append(outputs, "stderr")
+	}
+	if cfg.Stdout {
+		outputs = append(outputs, "stdout")
+	}
+	if cfg.File != "" {
+		outputs = append(outputs, cfg.File)
+	}
+	if cfg.URL != "" {
+		outputs = append(outputs, cfg.URL)
+	}
+	ws, _, err := zap.Open(outputs...)
+	if err != nil {
+		log.Warnf("redacting logs: opening log outputs: %s", err)
+		return
+	}
+
+	// the encoder go-log uses for cfg.Format
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch cfg.Format {
+	case logging.PlaintextOutput:
+		encCfg.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encCfg)
+	case logging.JSONOutput:
+		encoder = zapcore.NewJSONEncoder(encCfg)
+	default:
+		encCfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encCfg)
+	}
+	core := zapcore.NewCore(encoder, redactWriter{ws}, zapcore.DebugLevel)
+	for k, v := range cfg.Labels {
+		core = core.With([]zap.Field{zap.String(k, v)})
+	}
+	logging.SetPrimaryCore(core)
+}
+
+// redactWriter redacts every entry before it reaches the log output.
+type redactWriter struct {
+	zapcore.WriteSyncer
+}
+
+func (w redactWriter) Write(p []byte) (int, error) {
+	if _, err := w.WriteSyncer.Write([]byte(Redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -41,6 +41,12 @@ func NewStorageService() *StorageService {
 	return storage
 }
 
+// CheckMcsLogin logs in to MCS with the configured api key.
+func CheckMcsLogin() error {
+	_, err := user.LoginByApikeyV2(GetConfig().MCS.ApiKey, GetConfig().MCS.Network)
+	return err
+}
+
 func (storage *StorageService) UploadFileToBucket(objectName, filePath string, replace bool) (*bucket.OssFile, error) {
 	logs.GetLogger().Infof("uploading file to bucket, objectName: %s, filePath: %s", objectName, filePath)
 	buketClient := bucket.GetBucketClient(*storage.mcsClient)
@@ -71,6 +77,36 @@ func (storage *StorageService) UploadFileToBucket(objectName, filePath string, r
 	return mcsOssFile, nil
 }
 
+func (storage *StorageService) GetFile(objectName string) (*bucket.OssFile, error) {
+	return bucket.GetBucketClient(*storage.mcsClient).GetFile(storage.BucketName, objectName)
+}
+
+func (storage *StorageService) DeleteFile(objectName string) error {
+	return bucket.GetBucketClient(*storage.mcsClient).DeleteFile(storage.BucketName, objectName)
+}
+
+func (storage *StorageService) ListFiles(prefix string) ([]string, error) {
+	const pageSize = 100
+	buketClient := bucket.GetBucketClient(*storage.mcsClient)
+
+	var names []string
+	for offset := 0; ; offset += pageSize {
+		files, total, err := buketClient.ListFiles(storage.BucketName, prefix, pageSize, offset)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !f.IsFolder {
+				names = append(names, f.ObjectName)
+			}
+		}
+		if len(files) < pageSize || total == nil || offset+len(files) >= *total {
+			break
+		}
+	}
+	return names, nil
+}
+
 func (storage *StorageService) DeleteBucket(bucketName string) error {
 	return bucket.GetBucketClient(*storage.mcsClient).DeleteBucket(bucketName)
 }
@@ -83,12 +119,13 @@ func (storage *StorageService) CreateBucket(bucketName string) {
 	}
 }
 
-func (storage *StorageService) CreateFolder(prefix, folderName string) {
+func (storage *StorageService) CreateFolder(prefix, folderName string) error {
 	_, err := bucket.GetBucketClient(*storage.mcsClient).CreateFolder(storage.BucketName, folderName, prefix)
 	if err != nil {
 		logs.GetLogger().Errorf("Failed create folder, error: %v", err)
-		return
+		return err
 	}
+	return nil
 }
 
 func (storage *StorageService) GetGatewayUrl() (*string, error) {
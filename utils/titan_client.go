@@ -2,7 +2,6 @@ package utils
 
 import (
 	"context"
-	"fmt"
 	titan_storage "github.com/utopiosphe/titan-storage-sdk"
 	"strings"
 )
@@ -33,21 +32,22 @@ func NewTiTanClient(apiKey string) (*TiTanClient, error) {
 func (client *TiTanClient) UploadFile(filePath string, folderId int) (string, error) {
 	progress := func(doneSize int64, totalSize int64) {
 		if doneSize == totalSize {
-			fmt.Printf("%s upload success\n", filePath)
+			log.Debugf("%s upload success", filePath)
 		}
 	}
 
 	root, err := client.titanStorage.UploadFilesWithPath(context.Background(), filePath, progress, false, titan_storage.WithGroupID(folderId))
 	if err != nil {
-		fmt.Println("UploadFile error ", err.Error())
 		return "", err
 	}
 
 	assetResult, err := client.titanStorage.GetURL(context.Background(), root.String())
+	if err != nil {
+		return "", err
+	}
 
 	var url string
 	for _, l := range assetResult.URLs {
-		fmt.Println("UploadFile url: ", l)
 		if strings.HasPrefix(l, "https://"+root.String()) {
 			filenameIndex := strings.Index(l, "filename")
 			url = l[:strings.LastIndex(l, "?")] + "?" + l[filenameIndex:]